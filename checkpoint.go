@@ -0,0 +1,353 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultCheckpointInterval = 5 * time.Minute
+
+// checkpointRemoveTimeout bounds the removal of a checkpoint, which goes on after the run has been cancelled
+// so that a published or failed archive does not leave a checkpoint behind.
+const checkpointRemoveTimeout = time.Minute
+
+// archiveCheckpoint is the progress of an archive which is being built.
+// If the run is interrupted, the next run continues the same multipart upload
+// from the last checkpoint instead of building the archive from scratch.
+// Only zip archives are checkpointed.
+type archiveCheckpoint struct {
+	ArchiveKey string `json:"archiveKey"`
+	// HandledFingerprint is the fingerprint of the source files which have been handled. The archive is continued
+	// as long as they are still the first files of the archive, whatever has been added or updated after them.
+	HandledFingerprint string    `json:"handledFingerprint"`
+	Time               time.Time `json:"time"`
+	// NoOfHandledFiles is the number of source files of the archive which have been handled,
+	// the files of the archive are always handled in the same order.
+	NoOfHandledFiles int `json:"noOfHandledFiles"`
+	// NoOfZippedFiles is the number of handled files which have been written to the archive,
+	// the others have been left out because they could not be downloaded.
+	NoOfZippedFiles int `json:"noOfZippedFiles"`
+	NoOfReusedFiles int `json:"noOfReusedFiles"`
+	// LastKey is the key of the last handled file.
+	LastKey string `json:"lastKey"`
+	// Headers are the headers of the entries which have been written to the archive.
+	Headers []zip.FileHeader `json:"headers"`
+	Entries []manifestEntry  `json:"entries"`
+	Upload  uploadCheckpoint `json:"upload"`
+}
+
+type uploadCheckpoint struct {
+	UploadID string         `json:"uploadId,omitempty"`
+	Parts    []uploadedPart `json:"parts"`
+	// Size is the number of bytes which have been sent in the parts.
+	Size int64 `json:"size"`
+	// Pending holds the written bytes which have not been sent yet.
+	Pending   []byte `json:"pending"`
+	HashState []byte `json:"hashState"`
+	// Mirrors holds the uploads of the archive to the mirrors by the name of the mirror.
+	Mirrors map[string]uploadCheckpoint `json:"mirrors,omitempty"`
+}
+
+type uploadedPart struct {
+	PartNumber int64  `json:"partNumber"`
+	ETag       string `json:"etag"`
+	// ChecksumSHA256 is the base64 encoded SHA-256 checksum of the part, which the staged archive is verified with.
+	ChecksumSHA256 string `json:"checksumSha256"`
+}
+
+// checkpointStore keeps the checkpoints of the archives by the key of the archive.
+type checkpointStore interface {
+	load(ctx context.Context, archiveKey string) (*archiveCheckpoint, error)
+	save(ctx context.Context, checkpoint *archiveCheckpoint) error
+	remove(ctx context.Context, archiveKey string) error
+	// archiveKeys returns the keys of the archives which have a checkpoint.
+	archiveKeys(ctx context.Context) ([]string, error)
+}
+
+const checkpointFileSuffix = ".checkpoint.json"
+
+func checkpointFileName(archiveKey string) string {
+	return archiveKey + checkpointFileSuffix
+}
+
+// s3CheckpointStore keeps the checkpoints in a folder of the bucket.
+type s3CheckpointStore struct {
+	s3Config *s3Config
+}
+
+func newS3CheckpointStore(s3Config *s3Config, folder string) *s3CheckpointStore {
+	c := *s3Config
+	c.archivesFolder = folder
+	return &s3CheckpointStore{s3Config: &c}
+}
+
+func (s *s3CheckpointStore) load(ctx context.Context, archiveKey string) (*archiveCheckpoint, error) {
+	data, err := s.s3Config.getSidecarFile(ctx, checkpointFileName(archiveKey))
+	if err != nil {
+		return nil, fmt.Errorf("downloading checkpoint of archive %s: %w", archiveKey, err)
+	}
+
+	return decodeCheckpoint(archiveKey, data)
+}
+
+func (s *s3CheckpointStore) save(ctx context.Context, checkpoint *archiveCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	return s.s3Config.uploadSidecarFile(ctx, checkpointFileName(checkpoint.ArchiveKey), data, "application/json")
+}
+
+func (s *s3CheckpointStore) remove(ctx context.Context, archiveKey string) error {
+	return s.s3Config.deleteSidecarFile(ctx, checkpointFileName(archiveKey))
+}
+
+func (s *s3CheckpointStore) archiveKeys(ctx context.Context) ([]string, error) {
+	prefix := s.s3Config.archivesFolder + "/"
+	files, err := s.s3Config.storage.listFiles(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing checkpoints: %w", err)
+	}
+
+	var keys []string
+	for _, file := range files {
+		if strings.HasSuffix(file.key, checkpointFileSuffix) {
+			keys = append(keys, strings.TrimSuffix(strings.TrimPrefix(file.key, prefix), checkpointFileSuffix))
+		}
+	}
+	return keys, nil
+}
+
+// dirCheckpointStore keeps the checkpoints in a local directory, e.g. on a persistent volume.
+type dirCheckpointStore struct {
+	dir string
+}
+
+func newDirCheckpointStore(dir string) *dirCheckpointStore {
+	return &dirCheckpointStore{dir: dir}
+}
+
+func (s *dirCheckpointStore) path(archiveKey string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(checkpointFileName(archiveKey)))
+}
+
+func (s *dirCheckpointStore) load(_ context.Context, archiveKey string) (*archiveCheckpoint, error) {
+	data, err := os.ReadFile(s.path(archiveKey))
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint of archive %s: %w", archiveKey, err)
+	}
+
+	return decodeCheckpoint(archiveKey, data)
+}
+
+// save writes the checkpoint to a temporary file first, so an interrupted save does not corrupt the previous checkpoint.
+func (s *dirCheckpointStore) save(_ context.Context, checkpoint *archiveCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	path := s.path(checkpoint.ArchiveKey)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(path+".tmp", data, 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+
+	return nil
+}
+
+func (s *dirCheckpointStore) remove(_ context.Context, archiveKey string) error {
+	err := os.Remove(s.path(archiveKey))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *dirCheckpointStore) archiveKeys(_ context.Context) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == s.dir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, checkpointFileSuffix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, strings.TrimSuffix(filepath.ToSlash(rel), checkpointFileSuffix))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing checkpoints: %w", err)
+	}
+
+	return keys, nil
+}
+
+func decodeCheckpoint(archiveKey string, data []byte) (*archiveCheckpoint, error) {
+	checkpoint := &archiveCheckpoint{}
+	err := json.Unmarshal(data, checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("decoding checkpoint of archive %s: %w", archiveKey, err)
+	}
+
+	return checkpoint, nil
+}
+
+// checkpointer saves the progress of the archives regularly.
+type checkpointer struct {
+	store    checkpointStore
+	interval time.Duration
+	last     time.Time
+}
+
+// newCheckpointer returns nil if there is no store, so the archives are not checkpointed.
+func newCheckpointer(store checkpointStore, interval time.Duration) *checkpointer {
+	if store == nil {
+		return nil
+	}
+
+	return &checkpointer{
+		store:    store,
+		interval: interval,
+		last:     time.Now(),
+	}
+}
+
+// due tells whether the archives have to be checkpointed. A nil checkpointer never checkpoints.
+func (c *checkpointer) due() bool {
+	return c != nil && time.Since(c.last) >= c.interval
+}
+
+// resumableCheckpoint returns the checkpoint of the archive if the files it has handled are still the first of the provided files.
+// The checkpoints which cannot be continued are discarded with their uploads to the sinks of the provided config.
+func (c *checkpointer) resumableCheckpoint(ctx context.Context, s3Config *s3Config, archiveKey string, files []*fileInfo) *archiveCheckpoint {
+	if c == nil {
+		return nil
+	}
+
+	checkpoint, err := c.store.load(ctx, archiveKey)
+	if err != nil {
+		log.WithError(err).Debugf("There is no checkpoint of archive %s", archiveKey)
+		return nil
+	}
+
+	if checkpoint.ArchiveKey != archiveKey || checkpoint.NoOfHandledFiles > len(files) || checkpoint.NoOfZippedFiles > checkpoint.NoOfHandledFiles ||
+		checkpoint.HandledFingerprint != newSourceState(files[:checkpoint.NoOfHandledFiles]).fingerprint {
+		log.Infof("Checkpoint of archive %s has been saved for other source files, the archive will be built from scratch", archiveKey)
+		c.discard(ctx, s3Config, checkpoint)
+		return nil
+	}
+
+	return checkpoint
+}
+
+// discard aborts the uploads of the checkpoint which will not be continued, so s3 does not keep their parts,
+// and removes the checkpoint.
+func (c *checkpointer) discard(ctx context.Context, s3Config *s3Config, checkpoint *archiveCheckpoint) {
+	s3Config.abortCheckpointedUploads(ctx, checkpoint)
+	c.remove(ctx, checkpoint.ArchiveKey)
+}
+
+// discardArchive discards the checkpoint of the archive if it has one, e.g. because the archive has been skipped.
+func (c *checkpointer) discardArchive(ctx context.Context, s3Config *s3Config, archiveKey string) {
+	if c == nil {
+		return
+	}
+
+	checkpoint, err := c.store.load(ctx, archiveKey)
+	if err != nil {
+		return
+	}
+
+	log.Infof("Discarding checkpoint of archive %s, it is not continued", archiveKey)
+	c.discard(ctx, s3Config, checkpoint)
+}
+
+// discardStaleCheckpoints discards the checkpoints of the archives which are not built anymore,
+// e.g. because they have been removed from the plan, as their uploads would never be continued.
+func discardStaleCheckpoints(ctx context.Context, s3Config *s3Config, store checkpointStore, zipConfigs []*zipConfig) {
+	if store == nil {
+		return
+	}
+
+	planned := make(map[string]bool, len(zipConfigs))
+	for _, zipConfig := range zipConfigs {
+		planned[s3Config.withArchivesFolder(zipConfig.archivesFolder).archiveKey(zipConfig.zipName)] = true
+	}
+
+	archiveKeys, err := store.archiveKeys(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Cannot look up the checkpoints of the archives which are not built anymore")
+		return
+	}
+
+	c := newCheckpointer(store, defaultCheckpointInterval)
+	for _, archiveKey := range archiveKeys {
+		if !planned[archiveKey] {
+			c.discardArchive(ctx, s3Config, archiveKey)
+		}
+	}
+}
+
+// abortCheckpointedUploads aborts the multipart uploads of the checkpoint to the destination and to the mirrors.
+// A failed abort does not stop the run, the parts are left to the lifecycle rules of the bucket.
+func (s3Config *s3Config) abortCheckpointedUploads(ctx context.Context, checkpoint *archiveCheckpoint) {
+	for _, sink := range s3Config.sinks() {
+		upload := checkpoint.Upload
+		if sink.name != destinationSinkName {
+			upload = checkpoint.Upload.Mirrors[sink.name]
+		}
+
+		s3Storage, ok := sink.config.storage.(*s3Storage)
+		if !ok || upload.UploadID == "" {
+			continue
+		}
+
+		err := s3Storage.abortMultipartUpload(ctx, stagingKey(checkpoint.ArchiveKey), upload.UploadID)
+		if err != nil {
+			log.WithError(err).Warnf("Cannot abort checkpointed upload of archive %s to sink %s", checkpoint.ArchiveKey, sink.name)
+		}
+	}
+}
+
+func (c *checkpointer) remove(ctx context.Context, archiveKey string) {
+	if c == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), checkpointRemoveTimeout)
+	defer cancel()
+
+	err := c.store.remove(ctx, archiveKey)
+	if err != nil {
+		log.WithError(err).Warnf("Cannot remove checkpoint of archive %s", archiveKey)
+	}
+}
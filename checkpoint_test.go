@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingCheckpointStore keeps every saved checkpoint, so a test can resume from any of them.
+type recordingCheckpointStore struct {
+	checkpointStore
+	saved []archiveCheckpoint
+}
+
+func (s *recordingCheckpointStore) save(ctx context.Context, checkpoint *archiveCheckpoint) error {
+	s.saved = append(s.saved, *checkpoint)
+	return s.checkpointStore.save(ctx, checkpoint)
+}
+
+func TestDirCheckpointStore(t *testing.T) {
+	store := newDirCheckpointStore(t.TempDir())
+	checkpoint := &archiveCheckpoint{
+		ArchiveKey:      "archives/FT-archive-2016.zip",
+		NoOfZippedFiles: 2,
+		Headers:         []zip.FileHeader{newZipFileHeader("first.json", time.Date(2020, time.May, 3, 0, 0, 0, 0, time.UTC))},
+		Upload:          uploadCheckpoint{UploadID: "upload-id", Parts: []uploadedPart{{PartNumber: 1, ETag: "etag-1"}}, Pending: []byte("pending")},
+	}
+
+	assert.Nil(t, store.save(context.Background(), checkpoint))
+	loaded, err := store.load(context.Background(), checkpoint.ArchiveKey)
+	assert.Nil(t, err)
+	assert.Equal(t, checkpoint.Upload, loaded.Upload)
+	assert.Equal(t, checkpoint.Headers[0].Name, loaded.Headers[0].Name)
+	assert.Equal(t, checkpoint.Headers[0].Extra, loaded.Headers[0].Extra)
+
+	archiveKeys, err := store.archiveKeys(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{checkpoint.ArchiveKey}, archiveKeys)
+
+	assert.Nil(t, store.remove(context.Background(), checkpoint.ArchiveKey))
+	_, err = store.load(context.Background(), checkpoint.ArchiveKey)
+	assert.Error(t, err)
+	assert.Nil(t, store.remove(context.Background(), checkpoint.ArchiveKey))
+}
+
+func TestZipAndUploadFilesResumesFromCheckpoint(t *testing.T) {
+	files := []*fileInfo{
+		{key: fmt.Sprintf("test-folder/%s_2016-01-01.json", "0b2d3f6a-5b4e-11e7-9bc8-8055f264aa8b"), eTag: "etag-0"},
+		{key: fmt.Sprintf("test-folder/%s_2016-02-01.json", "1f0a0b6e-5b4e-11e7-9bc8-8055f264aa8b"), eTag: "etag-1"},
+		{key: fmt.Sprintf("test-folder/%s_2016-03-01.json", "2a1c5d0e-5b4e-11e7-9bc8-8055f264aa8b"), eTag: "etag-2"},
+		{key: fmt.Sprintf("test-folder/%s_2016-04-01.json", "3b4e6f1a-5b4e-11e7-9bc8-8055f264aa8b"), eTag: "etag-3"},
+	}
+	zipConfigs := []*zipConfig{newZipConfig("FT-archive-2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016)}
+	store := &recordingCheckpointStore{checkpointStore: newDirCheckpointStore(t.TempDir())}
+
+	//the first run saves a checkpoint after every file
+	mockClient := &mockS3Client{}
+	bucket := newS3Storage(mockClient, "test-bucket")
+	bucket.partSize = 64
+	s3Config := newStorageConfig(bucket, "archives")
+	results := zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, newCheckpointer(store, 0), nil)
+	assert.False(t, hasFailures(results))
+	assert.Len(t, store.saved, len(files)-1)
+	_, err := store.load(context.Background(), "archives/FT-archive-2016.zip")
+	assert.Error(t, err, "checkpoint should be removed once the archive is uploaded")
+
+	//the second run continues the upload of the first one after its second file,
+	//the files which have been added or updated since do not come before it
+	checkpoint := store.saved[1]
+	assert.Equal(t, 2, checkpoint.NoOfHandledFiles)
+	assert.Equal(t, 2, checkpoint.NoOfZippedFiles)
+	assert.Equal(t, files[1].key, checkpoint.LastKey)
+	assert.NotEmpty(t, checkpoint.Upload.Parts)
+	assert.Nil(t, store.save(context.Background(), &checkpoint))
+
+	files = append(files[:3:3],
+		&fileInfo{key: files[3].key, eTag: "etag-3-updated"},
+		&fileInfo{key: fmt.Sprintf("test-folder/%s_2016-05-01.json", "4c5f7a2b-5b4e-11e7-9bc8-8055f264aa8b"), eTag: "etag-4"},
+	)
+	resumedClient := &mockS3Client{uploadedParts: mockClient.uploadedParts[:len(checkpoint.Upload.Parts)], uploadChecksums: true}
+	bucket = newS3Storage(resumedClient, "test-bucket")
+	bucket.partSize = 64
+	s3Config = newStorageConfig(bucket, "archives")
+	results = zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, newCheckpointer(store, time.Hour), nil)
+	assert.False(t, hasFailures(results))
+	assert.Equal(t, int64(3), resumedClient.getObjectCalls)
+
+	data, metadata, ok := resumedClient.storedObject("archives/FT-archive-2016.zip")
+	assert.True(t, ok)
+	assert.True(t, newSourceState(files).matches(metadata), "the resumed archive is described by the current files")
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.Nil(t, err)
+	assert.Len(t, zipReader.File, len(files)+1)
+	for i, file := range files {
+		f, err := zipReader.File[i].Open()
+		assert.Nil(t, err)
+		content, err := io.ReadAll(f)
+		assert.Nil(t, err)
+		assert.Equal(t, file.key, string(content))
+	}
+
+	manifest, err := s3Config.getManifest(context.Background(), "FT-archive-2016.zip")
+	assert.Nil(t, err)
+	assert.Len(t, manifest.Entries, len(files))
+
+	checksum, _, ok := resumedClient.storedObject("archives/FT-archive-2016.zip.sha256")
+	assert.True(t, ok)
+	assert.Equal(t, fmt.Sprintf("%x  FT-archive-2016.zip\n", sha256.Sum256(data)), string(checksum))
+}
+
+func TestZipAndUploadFilesIgnoresCheckpointOfOtherSourceFiles(t *testing.T) {
+	files := []*fileInfo{
+		{key: fmt.Sprintf("test-folder/%s_2016-10-30.json", contentUUID), eTag: "etag"},
+	}
+	zipConfigs := []*zipConfig{newZipConfig("FT-archive-2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016)}
+	store := newDirCheckpointStore(t.TempDir())
+	assert.Nil(t, store.save(context.Background(), &archiveCheckpoint{
+		ArchiveKey:         "archives/FT-archive-2016.zip",
+		HandledFingerprint: "other",
+		NoOfHandledFiles:   1,
+		NoOfZippedFiles:    1,
+		Upload:             uploadCheckpoint{UploadID: "upload-id"},
+	}))
+
+	mockClient := &mockS3Client{}
+	s3Config := newS3Config(mockClient, "test-bucket", "archives")
+	results := zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, newCheckpointer(store, time.Hour), nil)
+
+	assert.False(t, hasFailures(results))
+	assert.Equal(t, int64(1), mockClient.getObjectCalls)
+	_, err := store.load(context.Background(), "archives/FT-archive-2016.zip")
+	assert.Error(t, err)
+	assert.Contains(t, mockClient.abortedUploads, "archives/.staging/FT-archive-2016.zip#upload-id", "the upload of the checkpoint is aborted")
+}
+
+func TestDiscardStaleCheckpoints(t *testing.T) {
+	store := newDirCheckpointStore(t.TempDir())
+	for _, archiveKey := range []string{"archives/FT-archive-2016.zip", "archives/FT-archive-removed.zip"} {
+		assert.Nil(t, store.save(context.Background(), &archiveCheckpoint{
+			ArchiveKey: archiveKey,
+			Upload: uploadCheckpoint{
+				UploadID: "upload-" + path.Base(archiveKey),
+				Mirrors:  map[string]uploadCheckpoint{"s3://dr-bucket": {UploadID: "dr-upload-" + path.Base(archiveKey)}},
+			},
+		}))
+	}
+	mockClient := &mockS3Client{}
+	drClient := &mockS3Client{}
+	s3Config := newS3Config(mockClient, "test-bucket", "archives")
+	s3Config.mirrors = []mirror{{name: "s3://dr-bucket", storage: newS3Storage(drClient, "dr-bucket")}}
+	zipConfigs := []*zipConfig{newZipConfig("FT-archive-2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016)}
+
+	discardStaleCheckpoints(context.Background(), s3Config, store, zipConfigs)
+
+	archiveKeys, err := store.archiveKeys(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"archives/FT-archive-2016.zip"}, archiveKeys)
+	assert.Equal(t, []string{"archives/.staging/FT-archive-removed.zip#upload-FT-archive-removed.zip"}, mockClient.abortedUploads)
+	assert.Equal(t, []string{"archives/.staging/FT-archive-removed.zip#dr-upload-FT-archive-removed.zip"}, drClient.abortedUploads)
+}
+
+func TestZipAndUploadFilesDiscardsCheckpointOfSkippedArchive(t *testing.T) {
+	files := []*fileInfo{
+		{key: fmt.Sprintf("test-folder/%s_2016-10-30.json", contentUUID), eTag: "etag"},
+	}
+	zipConfigs := []*zipConfig{newZipConfig("FT-archive-2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016)}
+	mockClient := &mockS3Client{}
+	s3Config := newS3Config(mockClient, "test-bucket", "archives")
+	results := zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, nil, nil)
+	assert.False(t, hasFailures(results))
+
+	store := newDirCheckpointStore(t.TempDir())
+	assert.Nil(t, store.save(context.Background(), &archiveCheckpoint{ArchiveKey: "archives/FT-archive-2016.zip", Upload: uploadCheckpoint{UploadID: "upload-id"}}))
+	results = zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, newCheckpointer(store, time.Hour), nil)
+
+	assert.Equal(t, archiveSkipped, results[0].status)
+	_, err := store.load(context.Background(), "archives/FT-archive-2016.zip")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"archives/.staging/FT-archive-2016.zip#upload-id"}, mockClient.abortedUploads)
+}
+
+// cancellableCheckpointStore fails to remove a checkpoint with a cancelled context, like a request to S3.
+type cancellableCheckpointStore struct {
+	*dirCheckpointStore
+}
+
+func (s cancellableCheckpointStore) remove(ctx context.Context, archiveKey string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.dirCheckpointStore.remove(ctx, archiveKey)
+}
+
+func TestCheckpointerRemovesCheckpointAfterCancellation(t *testing.T) {
+	store := cancellableCheckpointStore{newDirCheckpointStore(t.TempDir())}
+	assert.Nil(t, store.save(context.Background(), &archiveCheckpoint{ArchiveKey: "archives/FT-archive-2016.zip"}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	newCheckpointer(store, time.Hour).remove(ctx, "archives/FT-archive-2016.zip")
+
+	_, err := store.load(context.Background(), "archives/FT-archive-2016.zip")
+	assert.Error(t, err)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	underscoreSuffixExtractorName = "underscore-suffix"
+	hivePathExtractorName         = "hive-path"
+	regexExtractorName            = "regex"
+	layoutExtractorName           = "layout"
+
+	// regexExtractorGroup is the named capture of a regex extractor which holds the date.
+	regexExtractorGroup = "date"
+)
+
+// dateExtractor extracts the publish date of a file from its s3 key.
+type dateExtractor func(s3ObjectKey string) (time.Time, error)
+
+// objectSource reads the metadata and the contents of the source files,
+// for the keys which do not carry their publish date.
+type objectSource interface {
+	headObject(ctx context.Context, key string) (*objectHead, error)
+	prefetchFileContents(ctx context.Context, key string) *downloadedFile
+	failedDate(key string) (extractedDate, bool)
+	keepFailedDate(key string, extracted extractedDate)
+}
+
+type extractedDate struct {
+	date time.Time
+	err  error
+	// retryable tells that the file could not be read because of an error which a retry can fix.
+	retryable bool
+}
+
+// hivePathPattern matches the year, month and day partitions of keys like prefix/2024/05/03/<uuid>.json.
+var hivePathPattern = regexp.MustCompile(`(?:^|/)(\d{4}/\d{2}/\d{2})/`)
+
+// dateExtractionSpec chooses how the publish dates of the files of a source folder are extracted.
+type dateExtractionSpec struct {
+	// Type is one of underscore-suffix (default), hive-path, regex or layout.
+	Type string `yaml:"type"`
+	// Pattern is the regular expression of a regex extractor. Its named capture "date" holds the date.
+	Pattern string `yaml:"pattern"`
+	// Layout is the Go time layout the date captured by a regex extractor, or the file name of a layout extractor,
+	// is parsed with.
+	Layout string `yaml:"layout"`
+	// Metadata is the name of the user metadata, e.g. x-amz-meta-publish-date,
+	// which holds the date of the files whose key does not carry it.
+	Metadata string `yaml:"metadata"`
+	// JSONField is the top level field of the json body, e.g. publishedDate,
+	// which holds the date of the files whose key and metadata do not carry it.
+	JSONField string `yaml:"jsonField"`
+}
+
+func newDateExtractor(ctx context.Context, spec dateExtractionSpec, objects objectSource) (dateExtractor, error) {
+	var extractDate dateExtractor
+	switch spec.Type {
+	case "", underscoreSuffixExtractorName:
+		extractDate = extractDateFromS3ObjectKey
+
+	case hivePathExtractorName:
+		extractDate = extractDateFromHivePath
+
+	case regexExtractorName:
+		var err error
+		extractDate, err = newRegexDateExtractor(spec.Pattern, spec.Layout)
+		if err != nil {
+			return nil, err
+		}
+
+	case layoutExtractorName:
+		var err error
+		extractDate, err = newLayoutDateExtractor(spec.Layout)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown date extraction type %q", spec.Type)
+	}
+
+	if spec.Metadata == "" && spec.JSONField == "" {
+		return extractDate, nil
+	}
+
+	return newFallbackDateExtractor(ctx, extractDate, objects, spec.Metadata, spec.JSONField), nil
+}
+
+// newFallbackDateExtractor reads the dates which cannot be extracted from the keys from the user metadata
+// or from the json body of the files. The dates are cached, as every key is run
+// through the selectors of all the archives of its folder. The files are read with the provided context,
+// the ones which cannot be read because of an error which a retry can fix are kept by the objects until the end
+// of the selection pass, and read again by the lookups which come after it.
+func newFallbackDateExtractor(ctx context.Context, extractDate dateExtractor, objects objectSource, metadataName, jsonField string) dateExtractor {
+	metadataName = strings.TrimPrefix(strings.ToLower(metadataName), "x-amz-meta-")
+	var dates sync.Map
+
+	return func(s3ObjectKey string) (time.Time, error) {
+		date, err := extractDate(s3ObjectKey)
+		if err == nil {
+			return date, nil
+		}
+
+		if cached, ok := dates.Load(s3ObjectKey); ok {
+			extracted := cached.(extractedDate)
+			return extracted.date, extracted.err
+		}
+		if failed, ok := objects.failedDate(s3ObjectKey); ok {
+			return failed.date, failed.err
+		}
+
+		extracted := extractedDate{err: err}
+		if metadataName != "" {
+			extracted = extractDateFromMetadata(ctx, objects, s3ObjectKey, metadataName, extracted)
+		}
+		retryable := extracted.retryable
+		if jsonField != "" && extracted.err != nil {
+			extracted = extractDateFromJSONField(ctx, objects, s3ObjectKey, jsonField, extracted)
+		}
+
+		if extracted.err == nil || !retryable && !extracted.retryable {
+			dates.Store(s3ObjectKey, extracted)
+		} else {
+			objects.keepFailedDate(s3ObjectKey, extracted)
+		}
+		return extracted.date, extracted.err
+	}
+}
+
+func extractDateFromMetadata(ctx context.Context, objects objectSource, s3ObjectKey, metadataName string, previous extractedDate) extractedDate {
+	head, err := objects.headObject(ctx, s3ObjectKey)
+	if err != nil {
+		return extractedDate{err: fmt.Errorf("cannot get metadata of s3 file %s: %w", s3ObjectKey, err), retryable: classifyError(err) != retryReasonPermanent}
+	}
+
+	value, ok := metadataValue(head.metadata, metadataName)
+	if !ok {
+		return previous
+	}
+
+	date, err := parsePublishDate(value)
+	return extractedDate{date: date, err: err}
+}
+
+func extractDateFromJSONField(ctx context.Context, objects objectSource, s3ObjectKey, jsonField string, previous extractedDate) extractedDate {
+	file := objects.prefetchFileContents(ctx, s3ObjectKey)
+	if file.err != nil {
+		return extractedDate{err: fmt.Errorf("cannot download s3 file %s: %w", s3ObjectKey, file.err), retryable: classifyError(file.err) != retryReasonPermanent}
+	}
+
+	var fields map[string]interface{}
+	err := json.Unmarshal(file.data, &fields)
+	if err != nil {
+		return extractedDate{err: fmt.Errorf("s3 file %s is not a json object: %w", s3ObjectKey, err)}
+	}
+
+	value, ok := fields[jsonField].(string)
+	if !ok {
+		return previous
+	}
+
+	date, err := parsePublishDate(value)
+	return extractedDate{date: date, err: err}
+}
+
+// parsePublishDate parses the dates read from the metadata or the body of the files,
+// either RFC3339 timestamps or days formatted as YYYY-MM-DD.
+func parsePublishDate(value string) (time.Time, error) {
+	date, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return date, nil
+	}
+
+	date, err = time.Parse(dateFormat, value)
+	if err != nil {
+		return time.Now(), fmt.Errorf("cannot parse publish date %s", value)
+	}
+
+	return date, nil
+}
+
+// extractDateFromHivePath extracts the date from the last year/month/day partitions of the key.
+func extractDateFromHivePath(s3ObjectKey string) (time.Time, error) {
+	matches := hivePathPattern.FindAllStringSubmatch(s3ObjectKey, -1)
+	if len(matches) == 0 {
+		return time.Now(), fmt.Errorf("cannot find date partitions in s3 file key %s", s3ObjectKey)
+	}
+
+	date, err := time.Parse("2006/01/02", matches[len(matches)-1][1])
+	if err != nil {
+		return time.Now(), fmt.Errorf("cannot parse date from s3 file key %s, error was: %s", s3ObjectKey, err)
+	}
+
+	return date, nil
+}
+
+// newRegexDateExtractor extracts the date captured by the "date" group of the pattern and parses it with the layout.
+func newRegexDateExtractor(pattern, layout string) (dateExtractor, error) {
+	if pattern == "" || layout == "" {
+		return nil, fmt.Errorf("regex date extraction needs a pattern and a layout")
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid date extraction pattern: %w", err)
+	}
+
+	group := re.SubexpIndex(regexExtractorGroup)
+	if group < 0 {
+		return nil, fmt.Errorf("date extraction pattern %s has no named capture %q", pattern, regexExtractorGroup)
+	}
+
+	return func(s3ObjectKey string) (time.Time, error) {
+		match := re.FindStringSubmatch(s3ObjectKey)
+		if match == nil {
+			return time.Now(), fmt.Errorf("s3 file key %s does not match the date extraction pattern", s3ObjectKey)
+		}
+
+		date, err := time.Parse(layout, match[group])
+		if err != nil {
+			return time.Now(), fmt.Errorf("cannot parse date from s3 file key %s, error was: %s", s3ObjectKey, err)
+		}
+
+		return date, nil
+	}, nil
+}
+
+// newLayoutDateExtractor parses the file name of the key with the layout, with or without its extension,
+// e.g. 2024-05-03T10:15:00Z.json with the layout 2006-01-02T15:04:05Z07:00.
+func newLayoutDateExtractor(layout string) (dateExtractor, error) {
+	if layout == "" {
+		return nil, fmt.Errorf("layout date extraction needs a layout")
+	}
+
+	return func(s3ObjectKey string) (time.Time, error) {
+		fileName := path.Base(s3ObjectKey)
+		date, err := time.Parse(layout, fileName)
+		if err == nil {
+			return date, nil
+		}
+
+		date, err = time.Parse(layout, strings.TrimSuffix(fileName, path.Ext(fileName)))
+		if err != nil {
+			return time.Now(), fmt.Errorf("cannot parse date from s3 file key %s, error was: %s", s3ObjectKey, err)
+		}
+
+		return date, nil
+	}, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDateExtractors(t *testing.T) {
+	tests := []struct {
+		name        string
+		spec        dateExtractionSpec
+		s3ObjectKey string
+		want        time.Time
+		wantErr     bool
+	}{
+		{
+			name:        "UnderscoreSuffixByDefault",
+			s3ObjectKey: "content/" + contentUUID + "_2016-10-30.json",
+			want:        time.Date(2016, time.October, 30, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:        "HivePath",
+			spec:        dateExtractionSpec{Type: hivePathExtractorName},
+			s3ObjectKey: "content/2024/05/03/" + contentUUID + ".json",
+			want:        time.Date(2024, time.May, 3, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:        "HivePathWithoutPartitions",
+			spec:        dateExtractionSpec{Type: hivePathExtractorName},
+			s3ObjectKey: "content/2024/05/" + contentUUID + ".json",
+			wantErr:     true,
+		},
+		{
+			name:        "HivePathInvalidDate",
+			spec:        dateExtractionSpec{Type: hivePathExtractorName},
+			s3ObjectKey: "content/2024/13/03/" + contentUUID + ".json",
+			wantErr:     true,
+		},
+		{
+			name:        "RegexRFC3339",
+			spec:        dateExtractionSpec{Type: regexExtractorName, Pattern: `_(?P<date>[^_]+)\.json$`, Layout: time.RFC3339},
+			s3ObjectKey: "content/" + contentUUID + "_2024-05-03T10:15:00Z.json",
+			want:        time.Date(2024, time.May, 3, 10, 15, 0, 0, time.UTC),
+		},
+		{
+			name:        "RegexNoMatch",
+			spec:        dateExtractionSpec{Type: regexExtractorName, Pattern: `_(?P<date>[^_]+)\.json$`, Layout: time.RFC3339},
+			s3ObjectKey: "content/" + contentUUID + ".json",
+			wantErr:     true,
+		},
+		{
+			name:        "LayoutRFC3339",
+			spec:        dateExtractionSpec{Type: layoutExtractorName, Layout: time.RFC3339},
+			s3ObjectKey: "content/2024/2024-05-03T10:15:00Z.json",
+			want:        time.Date(2024, time.May, 3, 10, 15, 0, 0, time.UTC),
+		},
+		{
+			name:        "LayoutWithExtension",
+			spec:        dateExtractionSpec{Type: layoutExtractorName, Layout: "20060102T150405Z.json"},
+			s3ObjectKey: "content/20240503T101500Z.json",
+			want:        time.Date(2024, time.May, 3, 10, 15, 0, 0, time.UTC),
+		},
+		{
+			name:        "LayoutNoMatch",
+			spec:        dateExtractionSpec{Type: layoutExtractorName, Layout: time.RFC3339},
+			s3ObjectKey: "content/" + contentUUID + "_2024-05-03.json",
+			wantErr:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			extractDate, err := newDateExtractor(context.Background(), test.spec, nil)
+			assert.NoError(t, err)
+
+			date, err := extractDate(test.s3ObjectKey)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, test.want.Equal(date), "got %s", date)
+		})
+	}
+}
+
+func TestNewDateExtractorInvalid(t *testing.T) {
+	specs := []dateExtractionSpec{
+		{Type: "epoch"},
+		{Type: regexExtractorName, Layout: dateFormat},
+		{Type: regexExtractorName, Pattern: `_(\d{4}-\d{2}-\d{2})`, Layout: dateFormat},
+		{Type: regexExtractorName, Pattern: `_(?P<date>\d{4}`, Layout: dateFormat},
+		{Type: regexExtractorName, Pattern: `_(?P<date>\d{4}-\d{2}-\d{2})`},
+		{Type: layoutExtractorName},
+	}
+
+	for _, spec := range specs {
+		_, err := newDateExtractor(context.Background(), spec, nil)
+		assert.Error(t, err, "spec %+v", spec)
+	}
+}
+
+func TestFallbackDateExtractor(t *testing.T) {
+	mockClient := &mockS3Client{}
+	mockClient.storeObject("content/with-metadata.json", []byte(`{}`), map[string]*string{"Publish-Date": aws.String("2016-10-30T10:00:00Z")})
+	mockClient.storeObject("content/with-body.json", []byte(`{"publishedDate":"2017-03-01T08:30:00.000Z"}`), nil)
+	mockClient.storeObject("content/without-date.json", []byte(`{"title":"no date"}`), nil)
+	s3Config := newS3Config(mockClient, "test-bucket", "")
+
+	extractDate, err := newDateExtractor(context.Background(), dateExtractionSpec{Metadata: "x-amz-meta-publish-date", JSONField: "publishedDate"}, s3Config)
+	assert.NoError(t, err)
+
+	date, err := extractDate("content/" + contentUUID + "_2015-01-02.json")
+	assert.NoError(t, err)
+	assert.Equal(t, 2015, date.Year())
+
+	date, err = extractDate("content/with-metadata.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "2016-10-30", date.Format(dateFormat))
+
+	date, err = extractDate("content/with-body.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "2017-03-01", date.Format(dateFormat))
+
+	_, err = extractDate("content/without-date.json")
+	assert.Error(t, err)
+}
+
+// flakyObjectSource fails the first lookups of the metadata with the provided error.
+type flakyObjectSource struct {
+	*prefetchedFiles
+	failures int
+	err      error
+	heads    int
+}
+
+func (s *flakyObjectSource) keepFailedDate(key string, extracted extractedDate) {
+	s.putFailedDate(key, extracted)
+}
+
+func (s *flakyObjectSource) headObject(_ context.Context, _ string) (*objectHead, error) {
+	s.heads++
+	if s.heads <= s.failures {
+		return nil, s.err
+	}
+	return &objectHead{metadata: map[string]*string{"Publish-Date": aws.String("2016-10-30")}}, nil
+}
+
+func (s *flakyObjectSource) prefetchFileContents(_ context.Context, key string) *downloadedFile {
+	return &downloadedFile{key: key, err: errors.New("not expected")}
+}
+
+func TestFallbackDateExtractorCachesPermanentErrorsOnly(t *testing.T) {
+	tests := map[string]struct {
+		err       error
+		wantHeads int
+		wantErr   bool
+	}{
+		"transient error is looked up again after the selection pass": {
+			err:       awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error.", nil), 500, ""),
+			wantHeads: 2,
+		},
+		"permanent error is cached": {
+			err:       awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, ""),
+			wantHeads: 1,
+			wantErr:   true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			objects := &flakyObjectSource{prefetchedFiles: newPrefetchedFiles(maxPrefetchedBytes), failures: 1, err: test.err}
+			extractDate := newFallbackDateExtractor(context.Background(), extractDateFromS3ObjectKey, objects, "x-amz-meta-publish-date", "")
+
+			//every selector of the pass gets the failure without looking the file up again
+			for i := 0; i < 3; i++ {
+				_, err := extractDate("content/with-metadata.json")
+				assert.Error(t, err)
+			}
+			assert.Equal(t, 1, objects.heads)
+
+			objects.take("content/with-metadata.json")
+			date, err := extractDate("content/with-metadata.json")
+			assert.Equal(t, test.wantHeads, objects.heads)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "2016-10-30", date.Format(dateFormat))
+		})
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	log "github.com/sirupsen/logrus"
+)
+
+// dirStorage keeps the files in a local directory, the keys are the slash separated paths relative to it.
+// The metadata of the archives is kept next to them, as local files cannot carry it.
+type dirStorage struct {
+	root string
+}
+
+func newDirStorage(root string) *dirStorage {
+	return &dirStorage{root: root}
+}
+
+func (s *dirStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func objectMetadataFileName(key string) string {
+	return key + ".object-metadata.json"
+}
+
+// listFiles walks the directory of the prefix. The eTag of a file is derived from its size and modification time,
+// so a changed file gets another eTag, like on s3.
+func (s *dirStorage) listFiles(_ context.Context, prefix string) ([]*fileInfo, error) {
+	dir := s.path(path.Dir(prefix))
+	result := make([]*fileInfo, 0, 32)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) || strings.HasSuffix(key, ".upload") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		result = append(result, &fileInfo{
+			key:          key,
+			eTag:         fmt.Sprintf("%x-%x", info.Size(), info.ModTime().UnixNano()),
+			size:         info.Size(),
+			lastModified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].key < result[j].key })
+	return result, nil
+}
+
+func (s *dirStorage) readObject(_ context.Context, key string) ([]byte, error) {
+	return os.ReadFile(s.path(key))
+}
+
+// openObject opens the file on every read, so the reader does not have to be closed.
+func (s *dirStorage) openObject(_ context.Context, key string, _ int64) io.ReaderAt {
+	return &dirReaderAt{path: s.path(key)}
+}
+
+func (s *dirStorage) headObject(_ context.Context, key string) (*objectHead, error) {
+	info, err := os.Stat(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	head := &objectHead{size: info.Size()}
+	data, err := os.ReadFile(s.path(objectMetadataFileName(key)))
+	if err == nil {
+		var metadata map[string]string
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			return nil, fmt.Errorf("decoding metadata of %s: %w", key, err)
+		}
+		head.metadata = aws.StringMap(metadata)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return head, nil
+}
+
+// putObject writes the file to a temporary file first, so readers never see a partially written file.
+func (s *dirStorage) putObject(_ context.Context, key string, data []byte, _ string) error {
+	path := s.path(key)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(path+".tmp", data, 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+
+	return nil
+}
+
+func (s *dirStorage) deleteObject(_ context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *dirStorage) putArchive(ctx context.Context, key string, metadata map[string]*string) archiveUpload {
+	return &dirUpload{
+		ctx:      ctx,
+		storage:  s,
+		key:      key,
+		metadata: metadata,
+		hash:     sha256.New(),
+	}
+}
+
+type dirReaderAt struct {
+	path string
+}
+
+func (r *dirReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return f.ReadAt(p, off)
+}
+
+// dirUpload writes an archive to a temporary file next to its final path and renames it on Close.
+// The temporary file is kept when the upload is checkpointed, so a later run can continue it.
+type dirUpload struct {
+	ctx      context.Context
+	storage  *dirStorage
+	key      string
+	metadata map[string]*string
+	file     *os.File
+	hash     hash.Hash
+	size     int64
+	// staged tells whether the temporary file has been written completely.
+	staged bool
+}
+
+func (u *dirUpload) tempPath() string {
+	return u.storage.path(u.key) + ".upload"
+}
+
+func (u *dirUpload) open(flag int) error {
+	if u.file != nil {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(u.tempPath()), 0755)
+	if err != nil {
+		return err
+	}
+
+	u.file, err = os.OpenFile(u.tempPath(), flag, 0644)
+	return err
+}
+
+func (u *dirUpload) Write(p []byte) (int, error) {
+	if err := u.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := u.open(os.O_CREATE | os.O_TRUNC | os.O_WRONLY); err != nil {
+		return 0, fmt.Errorf("could not create file for archive %s: %w", u.key, err)
+	}
+
+	n, err := u.file.Write(p)
+	u.hash.Write(p[:n])
+	u.size += int64(n)
+	return n, err
+}
+
+// stage flushes and closes the temporary file, the archive is not moved to its final path yet.
+func (u *dirUpload) stage() error {
+	if u.staged {
+		return nil
+	}
+	if err := u.open(os.O_CREATE | os.O_TRUNC | os.O_WRONLY); err != nil {
+		return fmt.Errorf("could not create file for archive %s: %w", u.key, err)
+	}
+
+	err := u.file.Sync()
+	if closeErr := u.file.Close(); err == nil {
+		err = closeErr
+	}
+	u.file = nil
+	if err != nil {
+		return fmt.Errorf("could not write archive %s: %w", u.key, err)
+	}
+
+	u.staged = true
+	return nil
+}
+
+// Close stages the archive, unless it has already been staged, moves it to its final path and writes its metadata next to it.
+func (u *dirUpload) Close() error {
+	err := u.stage()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(u.tempPath(), u.storage.path(u.key))
+	if err != nil {
+		return fmt.Errorf("could not write archive %s: %w", u.key, err)
+	}
+
+	metadataKey := objectMetadataFileName(u.key)
+	if len(u.metadata) == 0 {
+		err = u.storage.deleteObject(u.ctx, metadataKey)
+	} else {
+		var data []byte
+		data, err = json.Marshal(aws.StringValueMap(u.metadata))
+		if err == nil {
+			err = u.storage.putObject(u.ctx, metadataKey, data, "application/json")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("could not write metadata of archive %s: %w", u.key, err)
+	}
+
+	log.Infof("Finished writing file %s. Size: %d bytes", u.key, u.size)
+	return nil
+}
+
+// Abort removes the temporary file.
+func (u *dirUpload) Abort() error {
+	if u.file != nil {
+		u.file.Close()
+		u.file = nil
+	}
+
+	err := os.Remove(u.tempPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove temporary file of archive %s: %w", u.key, err)
+	}
+
+	return nil
+}
+
+// checkpoint flushes the temporary file, so it holds everything the checkpoint covers.
+func (u *dirUpload) checkpoint() (uploadCheckpoint, error) {
+	if u.file != nil {
+		if err := u.file.Sync(); err != nil {
+			return uploadCheckpoint{}, err
+		}
+	}
+
+	hashState, err := u.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return uploadCheckpoint{}, err
+	}
+
+	return uploadCheckpoint{
+		Size:      u.size,
+		HashState: hashState,
+	}, nil
+}
+
+// resume continues writing the temporary file of a previous run.
+// Anything which has been written after the checkpoint is cut off.
+func (u *dirUpload) resume(checkpoint uploadCheckpoint) error {
+	info, err := os.Stat(u.tempPath())
+	if err != nil {
+		return fmt.Errorf("cannot find temporary file of archive %s: %w", u.key, err)
+	}
+	if info.Size() < checkpoint.Size {
+		return fmt.Errorf("temporary file of archive %s has %d bytes, the checkpoint needs %d", u.key, info.Size(), checkpoint.Size)
+	}
+
+	err = u.hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(checkpoint.HashState)
+	if err != nil {
+		return fmt.Errorf("cannot restore checksum of archive %s: %w", u.key, err)
+	}
+
+	if err := u.open(os.O_WRONLY); err != nil {
+		return fmt.Errorf("cannot open temporary file of archive %s: %w", u.key, err)
+	}
+	err = u.file.Truncate(checkpoint.Size)
+	if err == nil {
+		_, err = u.file.Seek(checkpoint.Size, io.SeekStart)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot resume temporary file of archive %s: %w", u.key, err)
+	}
+	u.size = checkpoint.Size
+
+	log.Infof("Resuming file %s after %d bytes", u.key, u.size)
+	return nil
+}
+
+func (u *dirUpload) setMetadata(metadata map[string]*string) {
+	u.metadata = metadata
+}
+
+func (u *dirUpload) archiveKey() string {
+	return u.key
+}
+
+func (u *dirUpload) archiveSize() int64 {
+	return u.size
+}
+
+func (u *dirUpload) sha256() string {
+	return hex.EncodeToString(u.hash.Sum(nil))
+}
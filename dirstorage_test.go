@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestFile(t *testing.T, dir, key, content string) {
+	path := filepath.Join(dir, filepath.FromSlash(key))
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestDirStorageListFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "test-folder/b.json", "b")
+	writeTestFile(t, dir, "test-folder/nested/c.json", "c")
+	writeTestFile(t, dir, "test-folder/a.json", "a")
+	writeTestFile(t, dir, "test-folder-other/d.json", "d")
+	writeTestFile(t, dir, "other/e.json", "e")
+
+	files, err := newDirStorage(dir).listFiles(context.Background(), "test-folder/")
+	assert.Nil(t, err)
+
+	keys := make([]string, 0, len(files))
+	for _, file := range files {
+		keys = append(keys, file.key)
+		assert.NotEmpty(t, file.eTag)
+	}
+	assert.Equal(t, []string{"test-folder/a.json", "test-folder/b.json", "test-folder/nested/c.json"}, keys)
+
+	files, err = newDirStorage(dir).listFiles(context.Background(), "missing-folder/")
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+}
+
+func TestZipAndUploadFilesToDir(t *testing.T) {
+	dir := t.TempDir()
+	keys := []string{
+		fmt.Sprintf("test-folder/%s_2016-01-01.json", "0b2d3f6a-5b4e-11e7-9bc8-8055f264aa8b"),
+		fmt.Sprintf("test-folder/%s_2016-02-01.json", "1f0a0b6e-5b4e-11e7-9bc8-8055f264aa8b"),
+		fmt.Sprintf("test-folder/%s_2017-03-01.json", "2a1c5d0e-5b4e-11e7-9bc8-8055f264aa8b"),
+	}
+	for _, key := range keys {
+		writeTestFile(t, dir, key, key)
+	}
+	zipConfigs := []*zipConfig{newZipConfig("FT-archive-2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016)}
+	s3Config := newStorageConfig(newDirStorage(dir), "archives")
+
+	files, err := s3Config.listFiles(context.Background(), "test-folder")
+	assert.Nil(t, err)
+	results := zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, nil, nil)
+	assert.False(t, hasFailures(results))
+
+	zipReader, err := zip.OpenReader(filepath.Join(dir, "archives", "FT-archive-2016.zip"))
+	assert.Nil(t, err)
+	defer zipReader.Close()
+	assert.Len(t, zipReader.File, 3)
+	for i, key := range keys[:2] {
+		f, err := zipReader.File[i].Open()
+		assert.Nil(t, err)
+		content, err := io.ReadAll(f)
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(content))
+	}
+	for _, name := range []string{"FT-archive-2016.zip.sha256", "FT-archive-2016.zip.meta.json", "FT-archive-2016.zip.manifest.json"} {
+		assert.FileExists(t, filepath.Join(dir, "archives", name))
+	}
+
+	//the second run finds the archive up to date
+	results = zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, nil, nil)
+	assert.False(t, hasFailures(results))
+	assert.Equal(t, archiveSkipped, results[0].status)
+}
+
+func TestDirUploadResume(t *testing.T) {
+	storage := newDirStorage(t.TempDir())
+	upload := storage.putArchive(context.Background(), "archives/test.zip", nil)
+	_, err := upload.Write([]byte("0123"))
+	assert.Nil(t, err)
+	checkpoint, err := upload.checkpoint()
+	assert.Nil(t, err)
+	_, err = upload.Write([]byte("lost"))
+	assert.Nil(t, err)
+
+	resumed := storage.putArchive(context.Background(), "archives/test.zip", nil)
+	assert.Nil(t, resumed.resume(checkpoint))
+	_, err = resumed.Write([]byte("4567"))
+	assert.Nil(t, err)
+	assert.Nil(t, resumed.Close())
+
+	data, err := storage.readObject(context.Background(), "archives/test.zip")
+	assert.Nil(t, err)
+	assert.Equal(t, "01234567", string(data))
+	assert.Equal(t, int64(8), resumed.archiveSize())
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(data)), resumed.sha256())
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const (
+	defaultDownloadWorkers = 10
+
+	// maxPrefetchedBytes is the most the files downloaded while the archives are selected take in memory
+	// until they are written to the archives.
+	maxPrefetchedBytes = 64 * 1024 * 1024
+)
+
+type downloadedFile struct {
+	key  string
+	data []byte
+	err  error
+}
+
+type downloadJob struct {
+	key   string
+	resCh chan *downloadedFile
+}
+
+// downloadFiles downloads the files with the provided keys using a bounded pool of workers.
+// The downloaded files are sent on the returned channel in the same order as the keys,
+// so the caller can add them to an archive in a deterministic order.
+// The returned stop function must be called once the caller is not interested in the remaining files.
+func (s3Config *s3Config) downloadFiles(ctx context.Context, fileKeys []string) (<-chan *downloadedFile, func()) {
+	noOfWorkers := s3Config.downloadWorkers
+	if noOfWorkers < 1 {
+		noOfWorkers = 1
+	}
+
+	jobs := make(chan downloadJob)
+	// ordered holds the result channels in the order of the keys.
+	// Its capacity limits how many files can be prefetched ahead of the caller.
+	ordered := make(chan chan *downloadedFile, noOfWorkers)
+	out := make(chan *downloadedFile)
+	done := make(chan struct{})
+
+	for i := 0; i < noOfWorkers; i++ {
+		go func() {
+			for job := range jobs {
+				job.resCh <- s3Config.downloadFileContents(ctx, job.key)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(ordered)
+		defer close(jobs)
+
+		for _, key := range fileKeys {
+			resCh := make(chan *downloadedFile, 1)
+			select {
+			case ordered <- resCh:
+			case <-done:
+				return
+			}
+
+			select {
+			case jobs <- downloadJob{key: key, resCh: resCh}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(out)
+
+		for resCh := range ordered {
+			select {
+			case res := <-resCh:
+				select {
+				case out <- res:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+
+	return out, stop
+}
+
+// downloadFileContents returns the file which has been prefetched with the key, or downloads it.
+func (s3Config *s3Config) downloadFileContents(ctx context.Context, fileKey string) *downloadedFile {
+	if file, ok := s3Config.prefetched.take(fileKey); ok {
+		return file
+	}
+
+	return s3Config.readFileContents(ctx, fileKey)
+}
+
+// prefetchFileContents downloads a file before it is written to the archives, e.g. to read its publish date from its body.
+// The file is kept until it is written, so it is not downloaded again, unless the prefetched files are already too big.
+func (s3Config *s3Config) prefetchFileContents(ctx context.Context, fileKey string) *downloadedFile {
+	file := s3Config.readFileContents(ctx, fileKey)
+	if file.err == nil {
+		s3Config.prefetched.put(file)
+	}
+
+	return file
+}
+
+// failedDate returns the fallback date lookup of the file which has failed during the selection pass with an error
+// which a retry can fix, so the other selectors of the pass do not look the file up again.
+func (s3Config *s3Config) failedDate(fileKey string) (extractedDate, bool) {
+	return s3Config.prefetched.failedDate(fileKey)
+}
+
+// keepFailedDate keeps a failed fallback date lookup until the file is written or forgotten, like a prefetched file.
+func (s3Config *s3Config) keepFailedDate(fileKey string, extracted extractedDate) {
+	s3Config.prefetched.putFailedDate(fileKey, extracted)
+}
+
+// forgetPrefetchedFiles drops the prefetched files which have not been written, e.g. because their archive has been skipped,
+// and their failed date lookups.
+func (s3Config *s3Config) forgetPrefetchedFiles(files []*fileInfo) {
+	for _, file := range files {
+		s3Config.prefetched.take(file.key)
+	}
+}
+
+func (s3Config *s3Config) readFileContents(ctx context.Context, fileKey string) *downloadedFile {
+	data, err := s3Config.source.readObject(ctx, fileKey)
+	if err != nil {
+		return &downloadedFile{key: fileKey, err: fmt.Errorf("downloading file: %w", err)}
+	}
+
+	return &downloadedFile{key: fileKey, data: data}
+}
+
+// prefetchedFiles holds the downloaded files by their key, up to maxBytes, and the date lookups which have failed
+// while the files have been selected.
+type prefetchedFiles struct {
+	mu          sync.Mutex
+	files       map[string]*downloadedFile
+	failedDates map[string]extractedDate
+	size        int64
+	maxBytes    int64
+}
+
+func newPrefetchedFiles(maxBytes int64) *prefetchedFiles {
+	return &prefetchedFiles{
+		files:       make(map[string]*downloadedFile),
+		failedDates: make(map[string]extractedDate),
+		maxBytes:    maxBytes,
+	}
+}
+
+func (p *prefetchedFiles) putFailedDate(key string, extracted extractedDate) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.failedDates[key] = extracted
+}
+
+func (p *prefetchedFiles) failedDate(key string) (extractedDate, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	extracted, ok := p.failedDates[key]
+	return extracted, ok
+}
+
+// put keeps the file if it fits into the remaining space.
+func (p *prefetchedFiles) put(file *downloadedFile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.files[file.key]; ok || p.size+int64(len(file.data)) > p.maxBytes {
+		return
+	}
+	p.files[file.key] = file
+	p.size += int64(len(file.data))
+}
+
+// take removes the file with the key and returns it. The failed date lookup of the file is dropped too,
+// so the date is looked up again, e.g. for the manifest once the file is written.
+func (p *prefetchedFiles) take(key string) (*downloadedFile, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.failedDates, key)
+	file, ok := p.files[key]
+	if !ok {
+		return nil, false
+	}
+	delete(p.files, key)
+	p.size -= int64(len(file.data))
+	return file, true
+}
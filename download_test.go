@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadFilesKeepsOrder(t *testing.T) {
+	for _, noOfWorkers := range []int{0, 1, 3, 10} {
+		s3Config := newS3Config(&mockS3Client{}, "test-bucket", "")
+		s3Config.downloadWorkers = noOfWorkers
+
+		downloadedFiles, stop := s3Config.downloadFiles(context.Background(), testFolderFiles)
+
+		var got []string
+		for f := range downloadedFiles {
+			assert.Nil(t, f.err)
+			assert.Equal(t, f.key, string(f.data))
+			got = append(got, f.key)
+		}
+		stop()
+
+		assert.Equal(t, testFolderFiles, got)
+	}
+}
+
+func TestDownloadFilesStop(t *testing.T) {
+	s3Config := newS3Config(&mockS3Client{}, "test-bucket", "")
+	s3Config.downloadWorkers = 2
+
+	downloadedFiles, stop := s3Config.downloadFiles(context.Background(), testFolderFiles)
+	f := <-downloadedFiles
+	assert.Equal(t, testFolderFiles[0], f.key)
+
+	stop()
+	stop()
+
+	// the channel is closed after stop, possibly after delivering files which were already downloaded
+	for range downloadedFiles {
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	zipFormatName    = "zip"
+	tarGzFormatName  = "tar.gz"
+	tarZstFormatName = "tar.zst"
+	ndjsonFormatName = "ndjson.gz"
+)
+
+// archiveWriter adds files to an archive of a specific format.
+type archiveWriter interface {
+	addEntry(name string, modified time.Time, data []byte) error
+	Close() error
+}
+
+// archiveFormat describes an output format of the archives.
+type archiveFormat struct {
+	name      string
+	extension string
+	// embedsManifest tells whether the manifest is added to the archive as an entry.
+	// The manifest is uploaded next to the archive anyway.
+	embedsManifest bool
+	newWriter      func(w io.Writer) (archiveWriter, error)
+}
+
+var archiveFormats = map[string]*archiveFormat{
+	zipFormatName: {
+		name:           zipFormatName,
+		extension:      ".zip",
+		embedsManifest: true,
+		newWriter:      newZipArchiveWriter,
+	},
+	tarGzFormatName: {
+		name:           tarGzFormatName,
+		extension:      ".tar.gz",
+		embedsManifest: true,
+		newWriter:      newTarGzArchiveWriter,
+	},
+	tarZstFormatName: {
+		name:           tarZstFormatName,
+		extension:      ".tar.zst",
+		embedsManifest: true,
+		newWriter:      newTarZstArchiveWriter,
+	},
+	ndjsonFormatName: {
+		name:      ndjsonFormatName,
+		extension: ".ndjson.gz",
+		newWriter: newNDJSONArchiveWriter,
+	},
+}
+
+func getArchiveFormat(name string) (*archiveFormat, error) {
+	format, ok := archiveFormats[name]
+	if !ok {
+		names := make([]string, 0, len(archiveFormats))
+		for n := range archiveFormats {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown archive format %s, supported formats are: %v", name, names)
+	}
+
+	return format, nil
+}
+
+// zipArchiveWriter writes zip archives. It is the only format whose entries
+// can be copied from a previous version of the archive without decompressing them
+// and whose writing can be resumed from a checkpoint.
+//
+// Entries are compressed before they are added, so their sizes are known upfront and every entry
+// is complete as soon as it has been added. Together with the headers of the added entries,
+// this lets an interrupted archive be continued by a new writer.
+type zipArchiveWriter struct {
+	zipWriter  *zip.Writer
+	out        *skipWriter
+	compressor *flate.Writer
+	compressed bytes.Buffer
+	headers    []zip.FileHeader
+}
+
+func newZipArchiveWriter(w io.Writer) (archiveWriter, error) {
+	out := &skipWriter{w: w}
+	return &zipArchiveWriter{
+		zipWriter: zip.NewWriter(out),
+		out:       out,
+	}, nil
+}
+
+// newResumedZipArchiveWriter continues an archive whose entries up to the checkpoint have already been written to w.
+// The entries are replayed with zeroed contents into the void, so the zip writer knows their offsets
+// and writes them to the central directory when the archive is closed.
+func newResumedZipArchiveWriter(w io.Writer, headers []zip.FileHeader) (*zipArchiveWriter, error) {
+	out := &skipWriter{w: w, skip: true}
+	a := &zipArchiveWriter{
+		zipWriter: zip.NewWriter(out),
+		out:       out,
+	}
+
+	for _, h := range headers {
+		err := a.createRaw(h, io.LimitReader(zeroReader{}, int64(h.CompressedSize64)))
+		if err != nil {
+			return nil, fmt.Errorf("cannot replay zip entry %s, error was: %s", h.Name, err)
+		}
+	}
+
+	err := a.zipWriter.Flush()
+	if err != nil {
+		return nil, err
+	}
+	out.skip = false
+	return a, nil
+}
+
+func (a *zipArchiveWriter) addEntry(name string, modified time.Time, data []byte) error {
+	a.compressed.Reset()
+	if a.compressor == nil {
+		compressor, err := flate.NewWriter(&a.compressed, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		a.compressor = compressor
+	} else {
+		a.compressor.Reset(&a.compressed)
+	}
+
+	_, err := a.compressor.Write(data)
+	if err != nil {
+		return err
+	}
+	err = a.compressor.Close()
+	if err != nil {
+		return err
+	}
+
+	h := newZipFileHeader(name, modified)
+	h.CRC32 = crc32.ChecksumIEEE(data)
+	h.CompressedSize64 = uint64(a.compressed.Len())
+	h.UncompressedSize64 = uint64(len(data))
+
+	err = a.createRaw(h, &a.compressed)
+	if err != nil {
+		return fmt.Errorf("cannot create zip header for file, error was: %s", err)
+	}
+
+	return nil
+}
+
+// copyEntry copies the compressed entry. Its data descriptor is dropped,
+// as the sizes are known from the previous archive.
+func (a *zipArchiveWriter) copyEntry(f *zip.File) error {
+	r, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+
+	h := f.FileHeader
+	h.Flags &^= 0x8
+	return a.createRaw(h, r)
+}
+
+func (a *zipArchiveWriter) createRaw(h zip.FileHeader, r io.Reader) error {
+	w, err := a.zipWriter.CreateRaw(&h)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+
+	a.headers = append(a.headers, h)
+	return nil
+}
+
+// flush writes the added entries to the underlying writer, so the writer can be checkpointed.
+func (a *zipArchiveWriter) flush() error {
+	return a.zipWriter.Flush()
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zipWriter.Close()
+}
+
+// newZipFileHeader creates the header zip.Writer.CreateHeader would create for a deflated file.
+func newZipFileHeader(name string, modified time.Time) zip.FileHeader {
+	h := zip.FileHeader{
+		Name:           name,
+		Method:         zip.Deflate,
+		Flags:          0x800,
+		CreatorVersion: 20,
+		ReaderVersion:  20,
+	}
+	if modified.IsZero() {
+		return h
+	}
+
+	// CreateRaw writes the MS-DOS time fields as they are, so they are set too
+	h.SetModTime(modified)
+	h.Modified = modified
+
+	// extended timestamp extra field, the same CreateHeader adds
+	extra := make([]byte, 9)
+	binary.LittleEndian.PutUint16(extra[0:], 0x5455)
+	binary.LittleEndian.PutUint16(extra[2:], 5)
+	extra[4] = 1
+	binary.LittleEndian.PutUint32(extra[5:], uint32(modified.Unix()))
+	h.Extra = extra
+	return h
+}
+
+// skipWriter drops everything written to it while skip is set.
+type skipWriter struct {
+	w    io.Writer
+	skip bool
+}
+
+func (s *skipWriter) Write(p []byte) (int, error) {
+	if s.skip {
+		return len(p), nil
+	}
+
+	return s.w.Write(p)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
+
+// tarArchiveWriter writes tar archives compressed with the provided compressor.
+type tarArchiveWriter struct {
+	tarWriter  *tar.Writer
+	compressor io.WriteCloser
+}
+
+func newTarGzArchiveWriter(w io.Writer) (archiveWriter, error) {
+	compressor := gzip.NewWriter(w)
+	return &tarArchiveWriter{
+		tarWriter:  tar.NewWriter(compressor),
+		compressor: compressor,
+	}, nil
+}
+
+func newTarZstArchiveWriter(w io.Writer) (archiveWriter, error) {
+	// all the archives of a folder are written at the same time, so every encoder runs in a single goroutine
+	compressor, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+
+	return &tarArchiveWriter{
+		tarWriter:  tar.NewWriter(compressor),
+		compressor: compressor,
+	}, nil
+}
+
+func (a *tarArchiveWriter) addEntry(name string, modified time.Time, data []byte) error {
+	h := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  modified,
+	}
+	err := a.tarWriter.WriteHeader(h)
+	if err != nil {
+		return fmt.Errorf("cannot create tar header for file, error was: %s", err)
+	}
+
+	_, err = a.tarWriter.Write(data)
+	return err
+}
+
+func (a *tarArchiveWriter) Close() error {
+	if err := a.tarWriter.Close(); err != nil {
+		return err
+	}
+
+	return a.compressor.Close()
+}
+
+// ndjsonArchiveWriter writes every file as a single line of a gzipped newline-delimited JSON file.
+type ndjsonArchiveWriter struct {
+	compressor io.WriteCloser
+	line       bytes.Buffer
+}
+
+func newNDJSONArchiveWriter(w io.Writer) (archiveWriter, error) {
+	return &ndjsonArchiveWriter{
+		compressor: gzip.NewWriter(w),
+	}, nil
+}
+
+func (a *ndjsonArchiveWriter) addEntry(name string, modified time.Time, data []byte) error {
+	a.line.Reset()
+	err := json.Compact(&a.line, data)
+	if err != nil {
+		return fmt.Errorf("file %s is not a valid json document: %w", name, err)
+	}
+	a.line.WriteByte('\n')
+
+	_, err = a.compressor.Write(a.line.Bytes())
+	return err
+}
+
+func (a *ndjsonArchiveWriter) Close() error {
+	return a.compressor.Close()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+var zipFormat = archiveFormats[zipFormatName]
+
+var testEntries = []struct {
+	name string
+	data string
+}{
+	{name: "first.json", data: "{\n  \"id\": 1\n}"},
+	{name: "second.json", data: `{"id": 2}`},
+}
+
+func writeTestArchive(t *testing.T, formatName string) []byte {
+	format, err := getArchiveFormat(formatName)
+	if err != nil {
+		t.Fatalf("did not expect error, got: %s", err)
+	}
+
+	var buf bytes.Buffer
+	writer, err := format.newWriter(&buf)
+	assert.Nil(t, err)
+
+	for _, entry := range testEntries {
+		err = writer.addEntry(entry.name, time.Date(2020, time.May, 3, 0, 0, 0, 0, time.UTC), []byte(entry.data))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, writer.Close())
+
+	return buf.Bytes()
+}
+
+func TestZipArchiveWriter(t *testing.T) {
+	data := writeTestArchive(t, zipFormatName)
+
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.Nil(t, err)
+	assert.Len(t, zipReader.File, len(testEntries))
+	for i, f := range zipReader.File {
+		r, err := f.Open()
+		assert.Nil(t, err)
+		content, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, testEntries[i].name, f.Name)
+		assert.Equal(t, testEntries[i].data, string(content))
+	}
+}
+
+func TestResumedZipArchiveWriter(t *testing.T) {
+	modified := time.Date(2020, time.May, 3, 0, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	w, err := newZipArchiveWriter(&buf)
+	assert.Nil(t, err)
+	writer := w.(*zipArchiveWriter)
+	assert.Nil(t, writer.addEntry(testEntries[0].name, modified, []byte(testEntries[0].data)))
+	assert.Nil(t, writer.flush())
+
+	//the second writer continues the archive without the first writer
+	resumed, err := newResumedZipArchiveWriter(&buf, writer.headers)
+	assert.Nil(t, err)
+	assert.Nil(t, resumed.addEntry(testEntries[1].name, modified, []byte(testEntries[1].data)))
+	assert.Nil(t, resumed.Close())
+
+	data := buf.Bytes()
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.Nil(t, err)
+	assert.Len(t, zipReader.File, len(testEntries))
+	for i, f := range zipReader.File {
+		r, err := f.Open()
+		assert.Nil(t, err)
+		content, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, testEntries[i].name, f.Name)
+		assert.Equal(t, testEntries[i].data, string(content))
+	}
+}
+
+func TestTarArchiveWriters(t *testing.T) {
+	tests := map[string]func(r io.Reader) (io.Reader, error){
+		tarGzFormatName: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		tarZstFormatName: func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+	}
+
+	for formatName, decompress := range tests {
+		t.Run(formatName, func(t *testing.T) {
+			data := writeTestArchive(t, formatName)
+
+			r, err := decompress(bytes.NewReader(data))
+			assert.Nil(t, err)
+			tarReader := tar.NewReader(r)
+			for _, entry := range testEntries {
+				h, err := tarReader.Next()
+				assert.Nil(t, err)
+				assert.Equal(t, entry.name, h.Name)
+				content, err := io.ReadAll(tarReader)
+				assert.Nil(t, err)
+				assert.Equal(t, entry.data, string(content))
+			}
+
+			_, err = tarReader.Next()
+			assert.Equal(t, io.EOF, err)
+		})
+	}
+}
+
+func TestNDJSONArchiveWriter(t *testing.T) {
+	data := writeTestArchive(t, ndjsonFormatName)
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	assert.Nil(t, err)
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	assert.Equal(t, []string{`{"id":1}`, `{"id":2}`}, lines)
+}
+
+func TestNDJSONArchiveWriterInvalidJSON(t *testing.T) {
+	writer, err := newNDJSONArchiveWriter(io.Discard)
+	assert.Nil(t, err)
+
+	err = writer.addEntry("invalid.json", time.Now(), []byte("not json"))
+
+	assert.NotNil(t, err)
+}
+
+func TestGetArchiveFormatUnknown(t *testing.T) {
+	_, err := getArchiveFormat("rar")
+
+	assert.NotNil(t, err)
+}
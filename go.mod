@@ -6,8 +6,10 @@ require (
 	github.com/Shopify/sarama v1.12.1-0.20170630174037-2fd980e23bdc
 	github.com/aws/aws-sdk-go v1.44.82
 	github.com/jawher/mow.cli v0.0.0-20170712113824-a6088643acff
+	github.com/klauspost/compress v1.18.0
 	github.com/sirupsen/logrus v1.5.0
 	github.com/stretchr/testify v1.3.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -1,23 +1,27 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	standardlog "log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/Shopify/sarama"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	cli "github.com/jawher/mow.cli"
 	log "github.com/sirupsen/logrus"
 )
 
+// version is set at build time
+var version = "dev"
+
 const (
-	last30DaysArchiveName    = "FT-archive-last-30-days.zip"
-	yearlyArchivesNameFormat = "FT-archive-%d.zip"
-	conceptsArchiveName      = "FT-archive-concepts.zip"
+	rollingWindowArchivesNameFormat = "FT-archive-last-%d-days"
+	conceptsArchiveName             = "FT-archive-concepts"
+	undatedArchiveName              = "FT-archive-undated"
+	dateRangeArchivesNameFormat     = "FT-archive-%s-to-%s"
 )
 
 func main() {
@@ -31,9 +35,27 @@ func main() {
 	maxNoOfGoroutines := app.Int(cli.IntOpt{
 		Name:   "max-no-of-goroutines",
 		Value:  3,
-		Desc:   "The maximum number of goroutines which is used to zip files.",
+		Desc:   "The maximum number of goroutines which is used to zip files. Each goroutine zips all the archives of a single s3 folder.",
 		EnvVar: "MAX_NO_OF_GOROUTINES",
 	})
+	maxNoOfDownloadWorkers := app.Int(cli.IntOpt{
+		Name:   "max-no-of-download-workers",
+		Value:  defaultDownloadWorkers,
+		Desc:   "The maximum number of files which are downloaded in parallel for a single archive.",
+		EnvVar: "MAX_NO_OF_DOWNLOAD_WORKERS",
+	})
+	maxOpenArchives := app.Int(cli.IntOpt{
+		Name:   "max-open-archives",
+		Value:  defaultMaxOpenArchives,
+		Desc:   "The maximum number of archives of a folder which are written at the same time. Every one of them holds an upload part in memory for each bucket it is published to. 0 writes all of them at once.",
+		EnvVar: "MAX_OPEN_ARCHIVES",
+	})
+	memoryLimitMiB := app.Int(cli.IntOpt{
+		Name:   "memory-limit-mib",
+		Value:  0,
+		Desc:   "The memory limit of the app in MiB. The app does not start if the archives which can be written at the same time need more than half of it. Not checked when it is 0.",
+		EnvVar: "MEMORY_LIMIT_MIB",
+	})
 	yearToStart := app.Int(cli.IntOpt{
 		Name:   "year-to-start",
 		Value:  1995,
@@ -41,6 +63,20 @@ func main() {
 		EnvVar: "YEAR_TO_START",
 	})
 
+	archiveGranularities := app.Strings(cli.StringsOpt{
+		Name:   "archive-granularities",
+		Value:  []string{yearSelectorName},
+		Desc:   "The periods the content is archived by, any of year, month or quarter. Used when no archive plan is provided.",
+		EnvVar: "ARCHIVE_GRANULARITIES",
+	})
+
+	rollingWindows := app.Strings(cli.StringsOpt{
+		Name:   "rolling-windows",
+		Value:  []string{"30d"},
+		Desc:   "The windows of the rolling archives, which hold the content published within the window before the run, either in days (e.g. 7d) or as a Go duration (e.g. 36h). Used when no archive plan is provided.",
+		EnvVar: "ROLLING_WINDOWS",
+	})
+
 	bucketName := app.String(cli.StringOpt{
 		Name:   "bucket-name",
 		Desc:   "bucket name of content",
@@ -53,6 +89,82 @@ func main() {
 		EnvVar: "BUCKET_REGION",
 	})
 
+	localDir := app.String(cli.StringOpt{
+		Name:   "local-dir",
+		Desc:   "Local directory which is used instead of the bucket, e.g. for local development without AWS. The folders are read from and the archives are written to this directory.",
+		EnvVar: "LOCAL_DIR",
+	})
+
+	destinationBucketName := app.String(cli.StringOpt{
+		Name:   "destination-bucket-name",
+		Desc:   "Bucket the archives, their sidecar files, the checkpoints and the run report are written to. Defaults to bucket-name, the source bucket is only read when they differ.",
+		EnvVar: "DESTINATION_BUCKET_NAME",
+	})
+
+	destinationBucketRegion := app.String(cli.StringOpt{
+		Name:   "destination-bucket-region",
+		Desc:   "Region of destination-bucket-name. Defaults to bucket-region.",
+		EnvVar: "DESTINATION_BUCKET_REGION",
+	})
+
+	destinationRoleARN := app.String(cli.StringOpt{
+		Name:   "destination-role-arn",
+		Desc:   "ARN of a role which is assumed to write to the destination bucket, e.g. a role of the account which owns it.",
+		EnvVar: "DESTINATION_ROLE_ARN",
+	})
+
+	mirrors := app.Strings(cli.StringsOpt{
+		Name:   "mirrors",
+		Desc:   "Comma separated storages every archive is copied to besides the destination bucket, either buckets (s3://<bucket>?region=<region>) or local directories (file:///<dir>), e.g. a DR bucket or an NFS mount.",
+		EnvVar: "MIRRORS",
+	})
+
+	s3Endpoint := app.String(cli.StringOpt{
+		Name:   "s3-endpoint",
+		Desc:   "URL of an S3 compatible store, e.g. MinIO, LocalStack or Ceph, which is used instead of AWS.",
+		EnvVar: "S3_ENDPOINT",
+	})
+
+	s3ForcePathStyle := app.Bool(cli.BoolOpt{
+		Name:   "s3-force-path-style",
+		Value:  false,
+		Desc:   "Flag which if it is set to true, the bucket is addressed in the path of the URLs instead of the host name. Most S3 compatible stores need it.",
+		EnvVar: "S3_FORCE_PATH_STYLE",
+	})
+
+	s3DisableSSL := app.Bool(cli.BoolOpt{
+		Name:   "s3-disable-ssl",
+		Value:  false,
+		Desc:   "Flag which if it is set to true, the S3 API is called over plain HTTP, e.g. for a local MinIO.",
+		EnvVar: "S3_DISABLE_SSL",
+	})
+
+	sourceAccessKeyID := app.String(cli.StringOpt{
+		Name:   "source-access-key-id",
+		Desc:   "Access key id which the source files are read with. Defaults to the credentials of the environment.",
+		EnvVar: "SOURCE_AWS_ACCESS_KEY_ID",
+	})
+
+	sourceSecretAccessKey := app.String(cli.StringOpt{
+		Name:      "source-secret-access-key",
+		Desc:      "Secret access key which the source files are read with.",
+		EnvVar:    "SOURCE_AWS_SECRET_ACCESS_KEY",
+		HideValue: true,
+	})
+
+	destinationAccessKeyID := app.String(cli.StringOpt{
+		Name:   "destination-access-key-id",
+		Desc:   "Access key id which the archives are written with. Defaults to the credentials of the environment.",
+		EnvVar: "DESTINATION_AWS_ACCESS_KEY_ID",
+	})
+
+	destinationSecretAccessKey := app.String(cli.StringOpt{
+		Name:      "destination-secret-access-key",
+		Desc:      "Secret access key which the archives are written with.",
+		EnvVar:    "DESTINATION_AWS_SECRET_ACCESS_KEY",
+		HideValue: true,
+	})
+
 	s3ConceptFolder := app.String(cli.StringOpt{
 		Name:   "s3-concept-folder",
 		Value:  "unarchived-concepts",
@@ -74,6 +186,59 @@ func main() {
 		EnvVar: "S3_ARCHIVES_FOLDER",
 	})
 
+	forceRebuild := app.Bool(cli.BoolOpt{
+		Name:   "force-rebuild",
+		Value:  false,
+		Desc:   "Flag which if it is set to true, the app will rebuild all the archives, even those whose source files have not changed since the previous run.",
+		EnvVar: "FORCE_REBUILD",
+	})
+
+	archiveFormatName := app.String(cli.StringOpt{
+		Name:   "archive-format",
+		Value:  zipFormatName,
+		Desc:   "Format of the archives. One of zip, tar.gz, tar.zst or ndjson.gz.",
+		EnvVar: "ARCHIVE_FORMAT",
+	})
+
+	archivePlanFile := app.String(cli.StringOpt{
+		Name:   "archive-plan",
+		Desc:   "Path of a yaml file which declares the archives to build. When it is not set, the concepts archive, the yearly archives and the archive of the last 30 days are built.",
+		EnvVar: "ARCHIVE_PLAN_FILE",
+	})
+
+	checkpointS3Folder := app.String(cli.StringOpt{
+		Name:   "checkpoint-s3-folder",
+		Desc:   "Name of the folder of the bucket where the progress of the zip archives is saved, so an interrupted run can be continued by the next one.",
+		EnvVar: "CHECKPOINT_S3_FOLDER",
+	})
+
+	checkpointDir := app.String(cli.StringOpt{
+		Name:   "checkpoint-dir",
+		Desc:   "Local directory, e.g. a persistent volume, where the progress of the zip archives is saved. Used instead of checkpoint-s3-folder.",
+		EnvVar: "CHECKPOINT_DIR",
+	})
+
+	checkpointInterval := app.String(cli.StringOpt{
+		Name:   "checkpoint-interval",
+		Value:  defaultCheckpointInterval.String(),
+		Desc:   "How often the progress of the zip archives is saved, as a Go duration.",
+		EnvVar: "CHECKPOINT_INTERVAL",
+	})
+
+	maxUnreadableFiles := app.Int(cli.IntOpt{
+		Name:   "max-unreadable-files",
+		Value:  0,
+		Desc:   "The number of files which cannot be downloaded that are left out of an archive and recorded in the run report before the archive fails.",
+		EnvVar: "MAX_UNREADABLE_FILES",
+	})
+
+	retryMaxElapsedTime := app.String(cli.StringOpt{
+		Name:   "s3-retry-max-elapsed-time",
+		Value:  defaultRetryMaxElapsedTime.String(),
+		Desc:   "How long a failing S3 call is retried with exponential backoff, as a Go duration. Permanent errors like AccessDenied are not retried.",
+		EnvVar: "S3_RETRY_MAX_ELAPSED_TIME",
+	})
+
 	logDebug := app.Bool(cli.BoolOpt{
 		Name:   "logDebug",
 		Value:  false,
@@ -83,6 +248,67 @@ func main() {
 
 	log.SetLevel(log.InfoLevel)
 
+	newPlanDefaults := func() planDefaults {
+		return planDefaults{
+			conceptFolder:      *s3ConceptFolder,
+			contentFolder:      *s3ContentFolder,
+			archivesFolder:     *s3ArchivesFolder,
+			archiveFormat:      *archiveFormatName,
+			yearToStart:        *yearToStart,
+			granularities:      *archiveGranularities,
+			rollingWindows:     *rollingWindows,
+			maxUnreadableFiles: *maxUnreadableFiles,
+		}
+	}
+
+	//the source files and the archives are accessed with their own credentials, e.g. a read-only key for the source files,
+	//and the archives can be published to another bucket, even in another region or account
+	newRunS3Config := func(retryMaxElapsed time.Duration) *s3Config {
+		sourceClient := s3ClientConfig{
+			region:          *bucketRegion,
+			endpoint:        *s3Endpoint,
+			forcePathStyle:  *s3ForcePathStyle,
+			disableSSL:      *s3DisableSSL,
+			accessKeyID:     *sourceAccessKeyID,
+			secretAccessKey: *sourceSecretAccessKey,
+		}
+		destinationClient := sourceClient
+		destinationClient.accessKeyID = *destinationAccessKeyID
+		destinationClient.secretAccessKey = *destinationSecretAccessKey
+		destinationClient.roleARN = *destinationRoleARN
+		if *destinationBucketRegion != "" {
+			destinationClient.region = *destinationBucketRegion
+		}
+		destinationBucket := *bucketName
+		if *destinationBucketName != "" {
+			destinationBucket = *destinationBucketName
+		}
+
+		s3Config := newStorageConfig(newStorage(*localDir, destinationClient, destinationBucket, retryMaxElapsed), *s3ArchivesFolder)
+		s3Config.source = newStorage(*localDir, sourceClient, *bucketName, retryMaxElapsed)
+		s3Config.downloadWorkers = *maxNoOfDownloadWorkers
+		s3Config.maxOpenArchives = *maxOpenArchives
+
+		//the mirror buckets are written with the credentials of the destination
+		for _, spec := range *mirrors {
+			mirrorSpec, err := parseMirrorSpec(spec)
+			if err != nil {
+				log.WithError(err).Error("Invalid mirror")
+				cli.Exit(1)
+			}
+
+			mirrorClient := destinationClient
+			if mirrorSpec.region != "" {
+				mirrorClient.region = mirrorSpec.region
+			}
+			s3Config.mirrors = append(s3Config.mirrors, mirror{
+				name:    mirrorSpec.name,
+				storage: newStorage(mirrorSpec.dir, mirrorClient, mirrorSpec.bucket, retryMaxElapsed),
+			})
+		}
+		return s3Config
+	}
+
 	app.Action = func() {
 		if *logDebug {
 			sarama.Logger = standardlog.New(os.Stdout, "[sarama] ", standardlog.LstdFlags)
@@ -90,31 +316,99 @@ func main() {
 		}
 
 		params := map[string]interface{}{
-			"s3-content-folder":    *s3ContentFolder,
-			"s3-concepts-folder":   *s3ConceptFolder,
-			"s3-archives-folder":   *s3ArchivesFolder,
-			"bucket-name":          *bucketName,
-			"bucket-region":        *bucketRegion,
-			"year-to-start":        *yearToStart,
-			"max-no-of-goroutines": *maxNoOfGoroutines,
-			"is-enabled":           *isAppEnabled,
+			"s3-content-folder":          *s3ContentFolder,
+			"s3-concepts-folder":         *s3ConceptFolder,
+			"s3-archives-folder":         *s3ArchivesFolder,
+			"bucket-name":                *bucketName,
+			"bucket-region":              *bucketRegion,
+			"destination-bucket-name":    *destinationBucketName,
+			"destination-bucket-region":  *destinationBucketRegion,
+			"destination-role-arn":       *destinationRoleARN,
+			"mirrors":                    *mirrors,
+			"local-dir":                  *localDir,
+			"s3-endpoint":                *s3Endpoint,
+			"s3-force-path-style":        *s3ForcePathStyle,
+			"s3-disable-ssl":             *s3DisableSSL,
+			"source-access-key-id":       *sourceAccessKeyID,
+			"destination-access-key-id":  *destinationAccessKeyID,
+			"year-to-start":              *yearToStart,
+			"archive-granularities":      *archiveGranularities,
+			"rolling-windows":            *rollingWindows,
+			"max-no-of-goroutines":       *maxNoOfGoroutines,
+			"max-no-of-download-workers": *maxNoOfDownloadWorkers,
+			"max-open-archives":          *maxOpenArchives,
+			"memory-limit-mib":           *memoryLimitMiB,
+			"is-enabled":                 *isAppEnabled,
+			"force-rebuild":              *forceRebuild,
+			"archive-format":             *archiveFormatName,
+			"archive-plan":               *archivePlanFile,
+			"checkpoint-s3-folder":       *checkpointS3Folder,
+			"checkpoint-dir":             *checkpointDir,
+			"checkpoint-interval":        *checkpointInterval,
+			"max-unreadable-files":       *maxUnreadableFiles,
+			"s3-retry-max-elapsed-time":  *retryMaxElapsedTime,
+			"version":                    version,
 		}
 		log.WithField("parameters", params).Info("Starting app")
 
-		if !*isAppEnabled {
-			log.Infof("App is not enabled. Please enable it by setting the IS_ENABLED env var.")
-			return
+		defaults := newPlanDefaults()
+		var plan *archivePlan
+		var err error
+		if *archivePlanFile != "" {
+			plan, err = loadArchivePlan(*archivePlanFile, defaults)
+		} else {
+			plan, err = defaultArchivePlan(defaults)
+		}
+		if err != nil {
+			log.WithError(err).Fatal("Cannot load archive plan")
 		}
 
-		sess, err := session.NewSession(aws.NewConfig().WithRegion(*bucketRegion))
+		//from now on the action exits with cli.Exit which, unlike log.Fatal, runs the deferred calls first
+		ctx, stop := newShutdownContext()
+		defer stop()
+
+		retryMaxElapsed, err := time.ParseDuration(*retryMaxElapsedTime)
 		if err != nil {
-			log.WithError(err).Fatal("creating aws session")
+			log.WithError(err).Error("Invalid max elapsed time of the S3 retries")
+			cli.Exit(1)
 		}
+		s3Config := newRunS3Config(retryMaxElapsed)
 
-		s3Client := s3.New(sess)
-		s3Config := newS3Config(s3Client, *bucketName, *s3ArchivesFolder)
+		zipConfigs, err := plan.zipConfigs(ctx, time.Now(), defaults, s3Config)
+		if err != nil {
+			log.WithError(err).Error("Invalid archive plan")
+			cli.Exit(1)
+		}
+		folders := groupBySourceFolder(zipConfigs, plan.Sources)
+		err = s3Config.checkMemoryLimit(folders, *maxNoOfGoroutines, int64(*memoryLimitMiB)<<20)
+		if err != nil {
+			log.WithError(err).Error("Archives do not fit into the memory limit")
+			cli.Exit(1)
+		}
+
+		interval, err := time.ParseDuration(*checkpointInterval)
+		if err != nil {
+			log.WithError(err).Error("Invalid checkpoint interval")
+			cli.Exit(1)
+		}
+		var checkpoints checkpointStore
+		if *checkpointDir != "" {
+			checkpoints = newDirCheckpointStore(*checkpointDir)
+		} else if *checkpointS3Folder != "" {
+			checkpoints = newS3CheckpointStore(s3Config, *checkpointS3Folder)
+		}
+
+		if !*isAppEnabled {
+			log.Infof("App is not enabled. Please enable it by setting the IS_ENABLED env var.")
+			return
+		}
+
+		//archives are published through staging objects, a crashed run may have left some of them behind
+		s3Config.cleanStaging(ctx, s3Config.archivesFolders(zipConfigs), defaultStagingMaxAge)
+		discardStaleCheckpoints(ctx, s3Config, checkpoints, zipConfigs)
 
 		startTime := time.Now()
+		report := newRunReport(startTime)
 		go func() {
 			for {
 				log.Infof("heartbeat [elapsed time: %s]", time.Since(startTime))
@@ -122,83 +416,156 @@ func main() {
 			}
 		}()
 
-		//concepts zipping
-		conceptFileKeys, err := s3Config.getFileKeys(*s3ConceptFolder)
-		if err != nil {
-			log.WithError(err).Fatal("Cannot get file keys from s3")
+		//every source folder is zipped in a single pass: each file is downloaded once
+		//and written into all the archives which select it
+		scheduler := newScheduler(*maxNoOfGoroutines)
+		for _, folder := range folders {
+			scheduler.add(&job{
+				name:      folder.folder,
+				priority:  folder.priority,
+				dependsOn: folder.dependsOn,
+				archives:  folder.archiveNames(),
+				run: func(ctx context.Context) []archiveResult {
+					return zipAndUploadFolder(ctx, s3Config, folder, *forceRebuild, newCheckpointer(checkpoints, interval), report)
+				},
+			})
 		}
 
-		//contents zipping
-		contentFileKeys, err := s3Config.getFileKeys(*s3ContentFolder)
+		results, err := scheduler.run(ctx)
 		if err != nil {
-			log.WithError(err).Fatal("Cannot get file keys from s3")
+			log.WithError(err).Error("Invalid archive plan")
+			cli.Exit(1)
+		}
+		logArchiveResults(results)
+		report.addArchiveResults(results)
+
+		reportErr := uploadRunReport(ctx, s3Config, report)
+		if reportErr != nil {
+			log.WithError(reportErr).Error("Cannot upload run report")
+		} else {
+			log.Infof("Uploaded run report %s with %d skipped files", report.fileName(), len(report.SkippedKeys))
 		}
 
-		errsCh := make(chan error)
-		//zip files on a per year basis
-		currentYear := time.Now().Year()
-
-		concurrentGoroutines := make(chan struct{}, *maxNoOfGoroutines)
-		// Fill the dummy channel with maxNbConcurrentGoroutines empty struct.
-		for i := 0; i < *maxNoOfGoroutines; i++ {
-			concurrentGoroutines <- struct{}{}
+		if ctx.Err() != nil {
+			log.Error("Zip creation process has been interrupted, the uploads in progress have been aborted")
+			cli.Exit(1)
+		}
+		if hasFailures(results) || reportErr != nil {
+			log.Error("Zip creation process finished with error")
+			cli.Exit(1)
 		}
 
-		// The done channel indicates when a single goroutine has
-		// finished its job.
-		done := make(chan bool)
-		// The waitForAllJobs channel allows the main program
-		// to wait until we have indeed done all the jobs.
-		waitForAllJobs := make(chan bool)
+		zippingUpDuration := time.Since(startTime)
+		log.Infof("Finished creating all the archives. Total duration is: %s", zippingUpDuration)
+	}
 
-		go func() {
-			<-done
-			// Say that another goroutine can now start.
-			concurrentGoroutines <- struct{}{}
-
-			for year := *yearToStart; year <= currentYear; year++ {
-				<-done
-				// Say that another goroutine can now start.
-				concurrentGoroutines <- struct{}{}
+	app.Command("range", "Builds a one-off archive with the content published between two dates", func(cmd *cli.Cmd) {
+		cmd.Spec = "--from --to [--name]"
+		from := cmd.String(cli.StringOpt{
+			Name: "from",
+			Desc: "The first day of the range, formatted as YYYY-MM-DD.",
+		})
+		to := cmd.String(cli.StringOpt{
+			Name: "to",
+			Desc: "The last day of the range, formatted as YYYY-MM-DD.",
+		})
+		name := cmd.String(cli.StringOpt{
+			Name: "name",
+			Desc: "Name of the archive, without the extension of the format. Defaults to FT-archive-<from>-to-<to>.",
+		})
+
+		cmd.Action = func() {
+			if *logDebug {
+				log.SetLevel(log.DebugLevel)
 			}
-			// We have collected all the jobs, the program
-			// can now terminate
-			waitForAllJobs <- true
-		}()
 
-		log.Infof("Zipping up files for concepts waiting to launch!")
-		<-concurrentGoroutines
-		zipConfig := newZipConfig(conceptsArchiveName, nil, 0, conceptFileKeys)
-		go zipAndUploadFiles(s3Config, zipConfig, done, errsCh)
+			fromDate, err := time.Parse(dateFormat, *from)
+			if err != nil {
+				log.WithError(err).Fatal("Invalid start of the date range")
+			}
+			toDate, err := time.Parse(dateFormat, *to)
+			if err != nil {
+				log.WithError(err).Fatal("Invalid end of the date range")
+			}
+			if toDate.Before(fromDate) {
+				log.Fatalf("Date range ends on %s, before it starts on %s", *to, *from)
+			}
 
-		for year := *yearToStart; year <= currentYear; year++ {
-			log.Infof("Zipping up files from year %d waiting to launch!", year)
-			<-concurrentGoroutines
+			archiveFormat, err := getArchiveFormat(*archiveFormatName)
+			if err != nil {
+				log.WithError(err).Fatal("Invalid archive format")
+			}
 
-			zipConfig := newZipConfig(fmt.Sprintf(yearlyArchivesNameFormat, year), isContentFromProvidedYear, year, contentFileKeys)
-			go zipAndUploadFiles(s3Config, zipConfig, done, errsCh)
-		}
+			archiveName := *name
+			if archiveName == "" {
+				archiveName = fmt.Sprintf(dateRangeArchivesNameFormat, *from, *to)
+			}
 
-		//wait for last archive to be finished.
-		<-done
+			params := map[string]interface{}{
+				"s3-content-folder":          *s3ContentFolder,
+				"s3-archives-folder":         *s3ArchivesFolder,
+				"bucket-name":                *bucketName,
+				"bucket-region":              *bucketRegion,
+				"destination-bucket-name":    *destinationBucketName,
+				"destination-bucket-region":  *destinationBucketRegion,
+				"destination-role-arn":       *destinationRoleARN,
+				"mirrors":                    *mirrors,
+				"local-dir":                  *localDir,
+				"s3-endpoint":                *s3Endpoint,
+				"s3-force-path-style":        *s3ForcePathStyle,
+				"s3-disable-ssl":             *s3DisableSSL,
+				"source-access-key-id":       *sourceAccessKeyID,
+				"destination-access-key-id":  *destinationAccessKeyID,
+				"max-no-of-download-workers": *maxNoOfDownloadWorkers,
+				"archive-format":             *archiveFormatName,
+				"max-unreadable-files":       *maxUnreadableFiles,
+				"s3-retry-max-elapsed-time":  *retryMaxElapsedTime,
+				"archive-plan":               *archivePlanFile,
+				"from":                       *from,
+				"to":                         *to,
+				"name":                       archiveName,
+				"version":                    version,
+			}
+			log.WithField("parameters", params).Info("Starting date range archive")
 
-		//zip files for last 30 days
-		zipConfig = newZipConfig(last30DaysArchiveName, isContentLessThanThirtyDaysBefore, 0, contentFileKeys)
-		go zipAndUploadFiles(s3Config, zipConfig, done, errsCh)
+			ctx, stop := newShutdownContext()
+			defer stop()
 
-		go func() {
-			err = <-errsCh
+			retryMaxElapsed, err := time.ParseDuration(*retryMaxElapsedTime)
 			if err != nil {
-				log.WithError(err).Fatal("Zip creation process finished with error")
+				log.WithError(err).Error("Invalid max elapsed time of the S3 retries")
+				cli.Exit(1)
+			}
+			s3Config := newRunS3Config(retryMaxElapsed)
+
+			//the dates are extracted like the plan extracts the dates of the content folder
+			extractDate := dateExtractor(extractDateFromS3ObjectKey)
+			if *archivePlanFile != "" {
+				plan, err := loadArchivePlan(*archivePlanFile, newPlanDefaults())
+				if err != nil {
+					log.WithError(err).Error("Cannot load archive plan")
+					cli.Exit(1)
+				}
+				extractDate, err = plan.sourceDateExtractor(ctx, *s3ContentFolder, s3Config)
+				if err != nil {
+					log.WithError(err).Error("Invalid archive plan")
+					cli.Exit(1)
+				}
 			}
-		}()
 
-		// Wait for all jobs to finish
-		<-waitForAllJobs
+			startTime := time.Now()
+			zipConfig := newZipConfig(archiveName, archiveFormat, dateRangeSelectorName, dateRangeSelector(extractDate, fromDate, toDate), 0)
+			zipConfig.extractDate = extractDate
+			zipConfig.maxUnreadableFiles = *maxUnreadableFiles
+			err = zipAndUploadFileKeys(ctx, s3Config, *s3ContentFolder, zipConfig)
+			if err != nil {
+				log.WithError(err).Error("Date range archive creation finished with error")
+				cli.Exit(1)
+			}
 
-		zippingUpDuration := time.Since(startTime)
-		log.Infof("Finished creating all the archives. Total duration is: %s", zippingUpDuration)
-	}
+			log.Infof("Finished creating archive %s. Total duration is: %s", zipConfig.zipName, time.Since(startTime))
+		}
+	})
 
 	err := app.Run(os.Args)
 	if err != nil {
@@ -206,6 +573,39 @@ func main() {
 	}
 }
 
+// newStorage returns the local directory if it is set, the bucket otherwise.
+func newStorage(localDir string, clientConfig s3ClientConfig, bucketName string, retryMaxElapsed time.Duration) storage {
+	if localDir != "" {
+		return newDirStorage(localDir)
+	}
+
+	s3Storage := newS3Storage(newS3Client(clientConfig), bucketName)
+	s3Storage.retry = newRetryPolicy(retryMaxElapsed)
+	return s3Storage
+}
+
+// newShutdownContext returns a context which is cancelled when the app receives SIGTERM or SIGINT,
+// e.g. when its kubernetes job is deleted or its node is drained.
+func newShutdownContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Warnf("Received signal %s, aborting the uploads in progress", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
 func init() {
 	f := &log.JSONFormatter{
 		TimestampFormat: time.RFC3339Nano,
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"time"
+)
+
+// manifestEntryName is the name of the entry which holds the manifest inside every archive.
+const manifestEntryName = "manifest.json"
+
+// archiveManifest lists what an archive holds and how it has been built.
+// It is added to the archive as its last entry and it is also uploaded next to the archive,
+// so the next run can reuse the entries whose source files have not changed.
+type archiveManifest struct {
+	ArchiveName       string          `json:"archiveName"`
+	Selector          string          `json:"selector"`
+	Year              int             `json:"year,omitempty"`
+	BuildTime         time.Time       `json:"buildTime"`
+	SourceFingerprint string          `json:"sourceFingerprint"`
+	Entries           []manifestEntry `json:"entries"`
+}
+
+type manifestEntry struct {
+	Name        string `json:"name"`
+	Key         string `json:"key"`
+	ETag        string `json:"etag"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	PublishDate string `json:"publishDate,omitempty"`
+}
+
+func newArchiveManifest(zipConfig *zipConfig) *archiveManifest {
+	return &archiveManifest{
+		ArchiveName: zipConfig.zipName,
+		Selector:    zipConfig.selectorName,
+		Year:        zipConfig.year,
+		Entries:     []manifestEntry{},
+	}
+}
+
+func newManifestEntry(name string, file *fileInfo, data []byte, extractDate dateExtractor) manifestEntry {
+	entry := manifestEntry{
+		Name:   name,
+		Key:    file.key,
+		ETag:   file.eTag,
+		Size:   int64(len(data)),
+		SHA256: fmt.Sprintf("%x", sha256.Sum256(data)),
+	}
+
+	if publishDate, err := extractDate(file.key); err == nil {
+		entry.PublishDate = publishDate.Format(dateFormat)
+	}
+
+	return entry
+}
+
+func manifestFileName(zipName string) string {
+	return zipName + ".manifest.json"
+}
+
+// previousArchive is an archive uploaded by a previous run.
+// Its unchanged entries are copied into the new archive in their compressed form,
+// without downloading the source files again.
+type previousArchive struct {
+	entries map[string]*previousEntry
+}
+
+type previousEntry struct {
+	manifestEntry
+	file *zip.File
+}
+
+func loadPreviousArchive(ctx context.Context, s3Config *s3Config, zipName string, head *objectHead) (*previousArchive, error) {
+	manifest, err := s3Config.getManifest(ctx, zipName)
+	if err != nil {
+		return nil, err
+	}
+
+	// the manifest is uploaded before the archive is published, so it may belong to a version of it which has not been published
+	fingerprint, _ := metadataValue(head.metadata, sourceFingerprintMetadata)
+	if fingerprint != manifest.SourceFingerprint {
+		return nil, fmt.Errorf("manifest of archive %s does not match the archive", zipName)
+	}
+
+	return newPreviousArchive(manifest, s3Config.openArchive(ctx, zipName, head.size), head.size)
+}
+
+func newPreviousArchive(manifest *archiveManifest, r io.ReaderAt, size int64) (*previousArchive, error) {
+	zipReader, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read existing archive: %w", err)
+	}
+
+	files := zipReader.File
+	if len(files) > 0 && files[len(files)-1].Name == manifestEntryName {
+		files = files[:len(files)-1]
+	}
+
+	if len(files) != len(manifest.Entries) {
+		return nil, fmt.Errorf("existing archive has %d entries, its manifest lists %d", len(files), len(manifest.Entries))
+	}
+
+	entries := make(map[string]*previousEntry, len(manifest.Entries))
+	for i, entry := range manifest.Entries {
+		f := files[i]
+		if f.Name != entry.Name {
+			return nil, fmt.Errorf("entry %d of existing archive is %s, its manifest lists %s", i, f.Name, entry.Name)
+		}
+
+		entries[entry.Key] = &previousEntry{
+			manifestEntry: entry,
+			file:          f,
+		}
+	}
+
+	return &previousArchive{
+		entries: entries,
+	}, nil
+}
+
+// reusableEntry returns the entry which holds the same version of the file, if there is one.
+// Entries of manifests without checksums are not reused, so every entry of the new manifest has one.
+func (p *previousArchive) reusableEntry(file *fileInfo) *previousEntry {
+	if p == nil || file.eTag == "" {
+		return nil
+	}
+
+	entry, ok := p.entries[file.key]
+	if !ok || entry.ETag != file.eTag || entry.SHA256 == "" {
+		return nil
+	}
+
+	return entry
+}
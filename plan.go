@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	yearlyArchivesNameTemplate    = "FT-archive-{{.Year}}"
+	monthlyArchivesNameTemplate   = "FT-archive-{{.Year}}-{{.Month}}"
+	quarterlyArchivesNameTemplate = "FT-archive-{{.Year}}-{{.Quarter}}"
+)
+
+// granularityNameTemplates holds the names of the periodic archives of the default plan by their granularity.
+var granularityNameTemplates = map[string]string{
+	yearSelectorName:    yearlyArchivesNameTemplate,
+	monthSelectorName:   monthlyArchivesNameTemplate,
+	quarterSelectorName: quarterlyArchivesNameTemplate,
+}
+
+// archivePlan declares which archives are built. The default plan is built from the app
+// parameters, any other plan can be loaded from a yaml file, e.g.:
+//
+//	archives:
+//	  - name: FT-archive-{{.Year}}
+//	    source: ${S3_CONTENT_FOLDER}
+//	    selector:
+//	      type: year
+//	      from: ${YEAR_TO_START}
+//	    format: tar.zst
+//	    destination: ${S3_ARCHIVES_FOLDER}
+type archivePlan struct {
+	// Sources configures the source folders by their name.
+	Sources  map[string]sourceSpec `yaml:"sources"`
+	Archives []archiveSpec         `yaml:"archives"`
+}
+
+type sourceSpec struct {
+	// DateExtraction chooses how the publish dates are extracted from the keys of the folder.
+	DateExtraction dateExtractionSpec `yaml:"dateExtraction"`
+	// Priority orders the folders which can be zipped at the same time, higher priorities start first.
+	Priority int `yaml:"priority"`
+	// DependsOn lists the source folders whose archives have to be built before the archives of this folder.
+	DependsOn []string `yaml:"dependsOn"`
+}
+
+type archiveSpec struct {
+	// Name is a text/template for the name of the archive, without the extension of the format.
+	// Archives with a year, month or quarter selector are built for every period, so the period must be part of the name.
+	Name string `yaml:"name"`
+	// Source is the s3 folder the files are selected from.
+	Source   string       `yaml:"source"`
+	Selector selectorSpec `yaml:"selector"`
+	// Format defaults to the ARCHIVE_FORMAT parameter.
+	Format string `yaml:"format"`
+	// Destination is the s3 folder the archive is uploaded to. Defaults to the S3_ARCHIVES_FOLDER parameter.
+	Destination string `yaml:"destination"`
+	// MaxUnreadableFiles is the error budget of the archive. Defaults to the MAX_UNREADABLE_FILES parameter.
+	MaxUnreadableFiles *int `yaml:"maxUnreadableFiles"`
+}
+
+type selectorSpec struct {
+	Type string `yaml:"type"`
+	// From and To are the first and last years of a year, month or quarter selector. To defaults to the current year.
+	From int `yaml:"from"`
+	To   int `yaml:"to"`
+	// Window is the length of a rolling window, either in days (e.g. 30d) or as a Go duration (e.g. 36h).
+	Window string `yaml:"window"`
+	// Start and End are the first and last days of a date range, formatted as YYYY-MM-DD.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	// Pattern is matched against the s3 keys with the syntax of path.Match.
+	Pattern string `yaml:"pattern"`
+}
+
+// archiveNameData is passed to the name templates of the archives.
+type archiveNameData struct {
+	Year int
+	// Month is formatted with two digits, e.g. 05.
+	Month string
+	// Quarter is formatted as Q1 to Q4.
+	Quarter string
+}
+
+// period is a calendar year, month or quarter which has its own archive.
+type period struct {
+	name           archiveNameData
+	fileSelectorFn fileSelector
+}
+
+// planDefaults holds the app parameters used by the default plan.
+// Plan files can reference them by the name of their env var, e.g. ${S3_CONTENT_FOLDER}.
+type planDefaults struct {
+	conceptFolder  string
+	contentFolder  string
+	archivesFolder string
+	archiveFormat  string
+	yearToStart    int
+	// granularities are the periods the content is archived by: year, month or quarter.
+	granularities []string
+	// rollingWindows are the windows of the archives with the latest content.
+	rollingWindows []string
+	// maxUnreadableFiles is the number of unreadable files every archive tolerates.
+	maxUnreadableFiles int
+}
+
+func (d planDefaults) variable(name string) string {
+	switch name {
+	case "S3_CONCEPT_FOLDER":
+		return d.conceptFolder
+	case "S3_CONTENT_FOLDER":
+		return d.contentFolder
+	case "S3_ARCHIVES_FOLDER":
+		return d.archivesFolder
+	case "ARCHIVE_FORMAT":
+		return d.archiveFormat
+	case "YEAR_TO_START":
+		return strconv.Itoa(d.yearToStart)
+	case "MAX_UNREADABLE_FILES":
+		return strconv.Itoa(d.maxUnreadableFiles)
+	}
+
+	return os.Getenv(name)
+}
+
+// defaultArchivePlan builds the concepts archive, one archive per period of every granularity
+// starting from the year to start, one archive per rolling window and the archive of the undated content.
+func defaultArchivePlan(defaults planDefaults) (*archivePlan, error) {
+	plan := &archivePlan{
+		Archives: []archiveSpec{
+			{
+				Name:     conceptsArchiveName,
+				Source:   defaults.conceptFolder,
+				Selector: selectorSpec{Type: allFilesSelectorName},
+			},
+		},
+	}
+
+	for _, granularity := range defaults.granularities {
+		nameTemplate, ok := granularityNameTemplates[granularity]
+		if !ok {
+			return nil, fmt.Errorf("unknown archive granularity %s, supported granularities are: year, month, quarter", granularity)
+		}
+
+		plan.Archives = append(plan.Archives, archiveSpec{
+			Name:     nameTemplate,
+			Source:   defaults.contentFolder,
+			Selector: selectorSpec{Type: granularity, From: defaults.yearToStart},
+		})
+	}
+
+	for _, window := range defaults.rollingWindows {
+		duration, err := parseWindow(window)
+		if err != nil {
+			return nil, err
+		}
+
+		plan.Archives = append(plan.Archives, archiveSpec{
+			Name:     rollingWindowArchiveName(window, duration),
+			Source:   defaults.contentFolder,
+			Selector: selectorSpec{Type: rollingWindowSelectorName, Window: window},
+		})
+	}
+
+	plan.Archives = append(plan.Archives, archiveSpec{
+		Name:     undatedArchiveName,
+		Source:   defaults.contentFolder,
+		Selector: selectorSpec{Type: undatedSelectorName},
+	})
+
+	return plan, nil
+}
+
+// rollingWindowArchiveName names the archive of a window by its number of days, e.g. FT-archive-last-30-days.
+// Windows which are not whole days are named after their definition, e.g. FT-archive-last-36h.
+func rollingWindowArchiveName(window string, duration time.Duration) string {
+	day := 24 * time.Hour
+	if duration%day == 0 {
+		return fmt.Sprintf(rollingWindowArchivesNameFormat, duration/day)
+	}
+
+	return "FT-archive-last-" + window
+}
+
+// loadArchivePlan reads the plan from a yaml file. References to ${NAME} are replaced
+// with the app parameters or with the env vars.
+func loadArchivePlan(fileName string, defaults planDefaults) (*archivePlan, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("reading archive plan: %w", err)
+	}
+
+	expanded := os.Expand(string(data), defaults.variable)
+	decoder := yaml.NewDecoder(strings.NewReader(expanded))
+	decoder.KnownFields(true)
+
+	plan := &archivePlan{}
+	err = decoder.Decode(plan)
+	if err != nil {
+		return nil, fmt.Errorf("decoding archive plan %s: %w", fileName, err)
+	}
+
+	if len(plan.Archives) == 0 {
+		return nil, fmt.Errorf("archive plan %s does not declare any archives", fileName)
+	}
+
+	return plan, nil
+}
+
+// zipConfigs validates the plan and creates the configs of all the archives it declares.
+// The objects are read with the provided context by the date extractors of the sources
+// which fall back to the metadata or the body of the files.
+func (p *archivePlan) zipConfigs(ctx context.Context, now time.Time, defaults planDefaults, objects objectSource) ([]*zipConfig, error) {
+	//a source which no archive is built from is most likely a typo of a folder name, its settings would be ignored
+	usedSources := make(map[string]bool, len(p.Archives))
+	for _, spec := range p.Archives {
+		usedSources[spec.Source] = true
+	}
+	folders := make([]string, 0, len(p.Sources))
+	for folder := range p.Sources {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+	for _, folder := range folders {
+		if !usedSources[folder] {
+			return nil, fmt.Errorf("source %s of the plan is not the source of any archive", folder)
+		}
+	}
+
+	extractors := make(map[string]dateExtractor, len(p.Sources))
+	for _, folder := range folders {
+		extractDate, err := p.sourceDateExtractor(ctx, folder, objects)
+		if err != nil {
+			return nil, err
+		}
+		extractors[folder] = extractDate
+	}
+
+	var zipConfigs []*zipConfig
+	archiveKeys := make(map[string]bool)
+
+	for i, spec := range p.Archives {
+		extractDate, ok := extractors[spec.Source]
+		if !ok {
+			extractDate = extractDateFromS3ObjectKey
+		}
+
+		configs, err := spec.zipConfigs(now, defaults, extractDate)
+		if err != nil {
+			return nil, fmt.Errorf("archive %d (%s) of the plan is invalid: %w", i+1, spec.Name, err)
+		}
+
+		for _, zipConfig := range configs {
+			archiveKey := path.Join(zipConfig.archivesFolder, zipConfig.zipName)
+			if archiveKeys[archiveKey] {
+				return nil, fmt.Errorf("archive %d (%s) of the plan is invalid: archive %s is declared more than once", i+1, spec.Name, archiveKey)
+			}
+			archiveKeys[archiveKey] = true
+		}
+
+		zipConfigs = append(zipConfigs, configs...)
+	}
+
+	return zipConfigs, nil
+}
+
+// sourceDateExtractor returns the date extractor of the source folder,
+// the one of the underscore suffix if the plan does not configure the folder.
+func (p *archivePlan) sourceDateExtractor(ctx context.Context, folder string, objects objectSource) (dateExtractor, error) {
+	source, ok := p.Sources[folder]
+	if !ok {
+		return extractDateFromS3ObjectKey, nil
+	}
+
+	extractDate, err := newDateExtractor(ctx, source.DateExtraction, objects)
+	if err != nil {
+		return nil, fmt.Errorf("source %s of the plan is invalid: %w", folder, err)
+	}
+
+	return extractDate, nil
+}
+
+func (s archiveSpec) zipConfigs(now time.Time, defaults planDefaults, extractDate dateExtractor) ([]*zipConfig, error) {
+	if s.Name == "" {
+		return nil, fmt.Errorf("name is missing")
+	}
+	if s.Source == "" {
+		return nil, fmt.Errorf("source is missing")
+	}
+
+	nameTemplate, err := template.New(s.Name).Option("missingkey=error").Parse(s.Name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name: %w", err)
+	}
+
+	formatName := s.Format
+	if formatName == "" {
+		formatName = defaults.archiveFormat
+	}
+	format, err := getArchiveFormat(formatName)
+	if err != nil {
+		return nil, err
+	}
+
+	destination := s.Destination
+	if destination == "" {
+		destination = defaults.archivesFolder
+	}
+
+	maxUnreadableFiles := defaults.maxUnreadableFiles
+	if s.MaxUnreadableFiles != nil {
+		maxUnreadableFiles = *s.MaxUnreadableFiles
+	}
+	if maxUnreadableFiles < 0 {
+		return nil, fmt.Errorf("maxUnreadableFiles cannot be negative")
+	}
+
+	newConfig := func(data archiveNameData, fileSelectorFn fileSelector) (*zipConfig, error) {
+		var name bytes.Buffer
+		err := nameTemplate.Execute(&name, data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name: %w", err)
+		}
+		if name.Len() == 0 {
+			return nil, fmt.Errorf("name is empty")
+		}
+
+		zipConfig := newZipConfig(name.String(), format, s.Selector.Type, fileSelectorFn, data.Year)
+		zipConfig.sourceFolder = s.Source
+		zipConfig.archivesFolder = destination
+		zipConfig.extractDate = extractDate
+		zipConfig.maxUnreadableFiles = maxUnreadableFiles
+		return zipConfig, nil
+	}
+
+	var zipConfigs []*zipConfig
+	selector := s.Selector
+	switch selector.Type {
+	case allFilesSelectorName:
+		zipConfig, err := newConfig(archiveNameData{}, nil)
+		if err != nil {
+			return nil, err
+		}
+		zipConfigs = append(zipConfigs, zipConfig)
+
+	case yearSelectorName, monthSelectorName, quarterSelectorName:
+		periods, err := selector.periods(now, extractDate)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, period := range periods {
+			zipConfig, err := newConfig(period.name, period.fileSelectorFn)
+			if err != nil {
+				return nil, err
+			}
+			zipConfigs = append(zipConfigs, zipConfig)
+		}
+
+	case rollingWindowSelectorName:
+		window, err := parseWindow(selector.Window)
+		if err != nil {
+			return nil, err
+		}
+
+		zipConfig, err := newConfig(archiveNameData{}, rollingWindowSelector(extractDate, window))
+		if err != nil {
+			return nil, err
+		}
+		zipConfigs = append(zipConfigs, zipConfig)
+
+	case dateRangeSelectorName:
+		start, err := time.Parse(dateFormat, selector.Start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start of date range: %w", err)
+		}
+		end, err := time.Parse(dateFormat, selector.End)
+		if err != nil {
+			return nil, fmt.Errorf("invalid end of date range: %w", err)
+		}
+		if end.Before(start) {
+			return nil, fmt.Errorf("date range ends before it starts")
+		}
+
+		zipConfig, err := newConfig(archiveNameData{}, dateRangeSelector(extractDate, start, end))
+		if err != nil {
+			return nil, err
+		}
+		zipConfigs = append(zipConfigs, zipConfig)
+
+	case undatedSelectorName:
+		zipConfig, err := newConfig(archiveNameData{}, nil)
+		if err != nil {
+			return nil, err
+		}
+		zipConfigs = append(zipConfigs, zipConfig)
+
+	case globSelectorName:
+		if selector.Pattern == "" {
+			return nil, fmt.Errorf("glob selector needs a pattern")
+		}
+		if _, err := path.Match(selector.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob pattern %s: %w", selector.Pattern, err)
+		}
+
+		zipConfig, err := newConfig(archiveNameData{}, globSelector(selector.Pattern))
+		if err != nil {
+			return nil, err
+		}
+		zipConfigs = append(zipConfigs, zipConfig)
+
+	default:
+		return nil, fmt.Errorf("unknown selector type %q", selector.Type)
+	}
+
+	return zipConfigs, nil
+}
+
+// periods lists the years, months or quarters between the from and to years.
+// Months and quarters which have not started yet are left out.
+func (s selectorSpec) periods(now time.Time, extractDate dateExtractor) ([]period, error) {
+	to := s.To
+	if to == 0 {
+		to = now.Year()
+	}
+	if s.From <= 0 || s.From > to {
+		return nil, fmt.Errorf("%s selector needs a from year before %d, got %d", s.Type, to, s.From)
+	}
+
+	var periods []period
+	for year := s.From; year <= to; year++ {
+		switch s.Type {
+		case yearSelectorName:
+			periods = append(periods, period{
+				name:           archiveNameData{Year: year},
+				fileSelectorFn: yearSelector(extractDate, year),
+			})
+
+		case monthSelectorName:
+			for month := time.January; month <= time.December; month++ {
+				if time.Date(year, month, 1, 0, 0, 0, 0, time.UTC).After(now) {
+					break
+				}
+				periods = append(periods, period{
+					name:           archiveNameData{Year: year, Month: fmt.Sprintf("%02d", month)},
+					fileSelectorFn: monthSelector(extractDate, year, month),
+				})
+			}
+
+		case quarterSelectorName:
+			for quarter := 1; quarter <= 4; quarter++ {
+				if time.Date(year, time.Month(quarter*3-2), 1, 0, 0, 0, 0, time.UTC).After(now) {
+					break
+				}
+				periods = append(periods, period{
+					name:           archiveNameData{Year: year, Quarter: fmt.Sprintf("Q%d", quarter)},
+					fileSelectorFn: quarterSelector(extractDate, year, quarter),
+				})
+			}
+		}
+	}
+
+	return periods, nil
+}
+
+// parseWindow parses the length of a rolling window, either in days (e.g. 30d) or as a Go duration.
+func parseWindow(window string) (time.Duration, error) {
+	var duration time.Duration
+	if days, ok := strings.CutSuffix(window, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid rolling window %q: %w", window, err)
+		}
+		duration = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			return 0, fmt.Errorf("invalid rolling window %q: %w", window, err)
+		}
+		duration = d
+	}
+
+	if duration <= 0 {
+		return 0, fmt.Errorf("rolling window %q must be positive", window)
+	}
+
+	return duration, nil
+}
+
+// sourceArchives holds all the archives which are built from the same s3 folder.
+type sourceArchives struct {
+	folder     string
+	zipConfigs []*zipConfig
+	priority   int
+	dependsOn  []string
+}
+
+// groupBySourceFolder groups the archives by their source folder,
+// so each folder is listed and zipped in a single pass.
+// The priority and the dependencies of the folders are taken from the sources of the plan.
+func groupBySourceFolder(zipConfigs []*zipConfig, sources map[string]sourceSpec) []*sourceArchives {
+	var groups []*sourceArchives
+	byFolder := make(map[string]*sourceArchives)
+	for _, zipConfig := range zipConfigs {
+		group, ok := byFolder[zipConfig.sourceFolder]
+		if !ok {
+			source := sources[zipConfig.sourceFolder]
+			group = &sourceArchives{
+				folder:    zipConfig.sourceFolder,
+				priority:  source.Priority,
+				dependsOn: source.DependsOn,
+			}
+			byFolder[zipConfig.sourceFolder] = group
+			groups = append(groups, group)
+		}
+		group.zipConfigs = append(group.zipConfigs, zipConfig)
+	}
+
+	return groups
+}
+
+func (g *sourceArchives) archiveNames() []string {
+	names := make([]string, 0, len(g.zipConfigs))
+	for _, zipConfig := range g.zipConfigs {
+		names = append(names, zipConfig.zipName)
+	}
+	return names
+}
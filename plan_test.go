@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testPlanDefaults = planDefaults{
+	conceptFolder:      "unarchived-concepts",
+	contentFolder:      "unarchived-content",
+	archivesFolder:     "yearly-archives",
+	archiveFormat:      zipFormatName,
+	yearToStart:        2022,
+	granularities:      []string{yearSelectorName},
+	rollingWindows:     []string{"30d"},
+	maxUnreadableFiles: 2,
+}
+
+func TestDefaultArchivePlan(t *testing.T) {
+	now := time.Date(2024, time.May, 3, 10, 0, 0, 0, time.UTC)
+
+	plan, err := defaultArchivePlan(testPlanDefaults)
+	assert.NoError(t, err)
+	zipConfigs, err := plan.zipConfigs(context.Background(), now, testPlanDefaults, nil)
+	assert.NoError(t, err)
+
+	var names []string
+	for _, zipConfig := range zipConfigs {
+		names = append(names, zipConfig.sourceFolder+"/"+zipConfig.zipName)
+		assert.Equal(t, "yearly-archives", zipConfig.archivesFolder)
+	}
+	assert.Equal(t, []string{
+		"unarchived-concepts/FT-archive-concepts.zip",
+		"unarchived-content/FT-archive-2022.zip",
+		"unarchived-content/FT-archive-2023.zip",
+		"unarchived-content/FT-archive-2024.zip",
+		"unarchived-content/FT-archive-last-30-days.zip",
+		"unarchived-content/FT-archive-undated.zip",
+	}, names)
+	assert.Equal(t, 2023, zipConfigs[2].year)
+
+	folders := groupBySourceFolder(zipConfigs, nil)
+	assert.Len(t, folders, 2)
+	assert.Equal(t, "unarchived-concepts", folders[0].folder)
+	assert.Len(t, folders[0].zipConfigs, 1)
+	assert.Equal(t, "unarchived-content", folders[1].folder)
+	assert.Len(t, folders[1].zipConfigs, 5)
+}
+
+func TestDefaultArchivePlanGranularities(t *testing.T) {
+	now := time.Date(2024, time.May, 3, 10, 0, 0, 0, time.UTC)
+	defaults := testPlanDefaults
+	defaults.yearToStart = 2023
+	defaults.granularities = []string{monthSelectorName, quarterSelectorName}
+
+	plan, err := defaultArchivePlan(defaults)
+	assert.NoError(t, err)
+	zipConfigs, err := plan.zipConfigs(context.Background(), now, defaults, nil)
+	assert.NoError(t, err)
+
+	var names []string
+	for _, zipConfig := range zipConfigs {
+		names = append(names, zipConfig.zipName)
+	}
+	assert.Len(t, names, 1+17+6+1+1)
+	assert.Equal(t, "FT-archive-2023-01.zip", names[1])
+	assert.Equal(t, "FT-archive-2024-05.zip", names[17])
+	assert.Equal(t, "FT-archive-2023-Q1.zip", names[18])
+	assert.Equal(t, "FT-archive-2024-Q2.zip", names[23])
+
+	selected, err := zipConfigs[17].fileSelectorFn("unarchived-content/uuid_2024-05-31.json")
+	assert.NoError(t, err)
+	assert.True(t, selected)
+	selected, err = zipConfigs[23].fileSelectorFn("unarchived-content/uuid_2024-04-01.json")
+	assert.NoError(t, err)
+	assert.True(t, selected)
+	selected, err = zipConfigs[23].fileSelectorFn("unarchived-content/uuid_2024-03-31.json")
+	assert.NoError(t, err)
+	assert.False(t, selected)
+
+	defaults.granularities = []string{"week"}
+	_, err = defaultArchivePlan(defaults)
+	assert.Error(t, err)
+}
+
+func TestDefaultArchivePlanRollingWindows(t *testing.T) {
+	defaults := testPlanDefaults
+	defaults.granularities = nil
+	defaults.rollingWindows = []string{"7d", "30d", "90d", "36h"}
+
+	plan, err := defaultArchivePlan(defaults)
+	assert.NoError(t, err)
+	zipConfigs, err := plan.zipConfigs(context.Background(), time.Now(), defaults, nil)
+	assert.NoError(t, err)
+
+	var names []string
+	for _, zipConfig := range zipConfigs[1 : len(zipConfigs)-1] {
+		names = append(names, zipConfig.zipName)
+		assert.Equal(t, rollingWindowSelectorName, zipConfig.selectorName)
+	}
+	assert.Equal(t, []string{
+		"FT-archive-last-7-days.zip",
+		"FT-archive-last-30-days.zip",
+		"FT-archive-last-90-days.zip",
+		"FT-archive-last-36h.zip",
+	}, names)
+
+	defaults.rollingWindows = []string{"a week"}
+	_, err = defaultArchivePlan(defaults)
+	assert.Error(t, err)
+}
+
+func TestLoadArchivePlan(t *testing.T) {
+	os.Setenv("TEST_PLAN_DESTINATION", "other-archives")
+	defer os.Unsetenv("TEST_PLAN_DESTINATION")
+
+	fileName := filepath.Join(t.TempDir(), "plan.yaml")
+	err := os.WriteFile(fileName, []byte(`
+archives:
+  - name: content-{{.Year}}
+    source: ${S3_CONTENT_FOLDER}
+    selector:
+      type: year
+      from: 2016
+      to: 2017
+    format: tar.zst
+  - name: videos
+    source: ${S3_CONTENT_FOLDER}
+    selector:
+      type: glob
+      pattern: "*/video_*"
+    destination: ${TEST_PLAN_DESTINATION}
+    maxUnreadableFiles: 0
+  - name: may-2016
+    source: ${S3_CONTENT_FOLDER}
+    selector:
+      type: date-range
+      start: 2016-05-01
+      end: 2016-05-31
+`), 0644)
+	assert.NoError(t, err)
+
+	plan, err := loadArchivePlan(fileName, testPlanDefaults)
+	assert.NoError(t, err)
+
+	zipConfigs, err := plan.zipConfigs(context.Background(), time.Now(), testPlanDefaults, nil)
+	assert.NoError(t, err)
+	assert.Len(t, zipConfigs, 4)
+
+	assert.Equal(t, "content-2016.tar.zst", zipConfigs[0].zipName)
+	assert.Equal(t, "content-2017.tar.zst", zipConfigs[1].zipName)
+	assert.Equal(t, "unarchived-content", zipConfigs[1].sourceFolder)
+	assert.Equal(t, "yearly-archives", zipConfigs[1].archivesFolder)
+	assert.Equal(t, 2, zipConfigs[1].maxUnreadableFiles)
+
+	assert.Equal(t, "videos.zip", zipConfigs[2].zipName)
+	assert.Equal(t, "other-archives", zipConfigs[2].archivesFolder)
+	assert.Equal(t, 0, zipConfigs[2].maxUnreadableFiles)
+	selected, err := zipConfigs[2].fileSelectorFn("unarchived-content/video_2016-05-03.json")
+	assert.NoError(t, err)
+	assert.True(t, selected)
+
+	selected, err = zipConfigs[3].fileSelectorFn("unarchived-content/uuid_2016-05-31.json")
+	assert.NoError(t, err)
+	assert.True(t, selected)
+	selected, err = zipConfigs[3].fileSelectorFn("unarchived-content/uuid_2016-06-01.json")
+	assert.NoError(t, err)
+	assert.False(t, selected)
+}
+
+func TestArchivePlanSourceDateExtraction(t *testing.T) {
+	plan := &archivePlan{
+		Sources: map[string]sourceSpec{
+			"hive-content":   {DateExtraction: dateExtractionSpec{Type: hivePathExtractorName}},
+			"layout-content": {DateExtraction: dateExtractionSpec{Type: layoutExtractorName, Layout: time.RFC3339}},
+		},
+		Archives: []archiveSpec{
+			{Name: "hive-{{.Year}}", Source: "hive-content", Selector: selectorSpec{Type: yearSelectorName, From: 2024, To: 2024}},
+			{Name: "content-{{.Year}}", Source: "content", Selector: selectorSpec{Type: yearSelectorName, From: 2024, To: 2024}},
+			{Name: "layout-{{.Year}}", Source: "layout-content", Selector: selectorSpec{Type: yearSelectorName, From: 2024, To: 2024}},
+		},
+	}
+
+	zipConfigs, err := plan.zipConfigs(context.Background(), time.Now(), testPlanDefaults, nil)
+	assert.NoError(t, err)
+
+	selected, err := zipConfigs[0].fileSelectorFn("hive-content/2024/05/03/" + contentUUID + ".json")
+	assert.NoError(t, err)
+	assert.True(t, selected)
+
+	_, err = zipConfigs[1].fileSelectorFn("content/2024/05/03/" + contentUUID + ".json")
+	assert.Error(t, err)
+
+	selected, err = zipConfigs[2].fileSelectorFn("layout-content/2024-05-03T10:15:00Z.json")
+	assert.NoError(t, err)
+	assert.True(t, selected)
+	selected, err = zipConfigs[2].fileSelectorFn("layout-content/2023-12-31T23:59:59Z.json")
+	assert.NoError(t, err)
+	assert.False(t, selected)
+
+	plan.Sources["hive-content"] = sourceSpec{DateExtraction: dateExtractionSpec{Type: "epoch"}}
+	_, err = plan.zipConfigs(context.Background(), time.Now(), testPlanDefaults, nil)
+	assert.Error(t, err)
+}
+
+func TestGroupBySourceFolderSchedule(t *testing.T) {
+	plan := &archivePlan{
+		Sources: map[string]sourceSpec{
+			"content": {Priority: 10, DependsOn: []string{"concepts"}},
+		},
+		Archives: []archiveSpec{
+			{Name: "concepts", Source: "concepts", Selector: selectorSpec{Type: allFilesSelectorName}},
+			{Name: "content-{{.Year}}", Source: "content", Selector: selectorSpec{Type: yearSelectorName, From: 2023, To: 2024}},
+		},
+	}
+
+	zipConfigs, err := plan.zipConfigs(context.Background(), time.Now(), testPlanDefaults, nil)
+	assert.NoError(t, err)
+
+	folders := groupBySourceFolder(zipConfigs, plan.Sources)
+	assert.Len(t, folders, 2)
+	assert.Equal(t, 0, folders[0].priority)
+	assert.Empty(t, folders[0].dependsOn)
+	assert.Equal(t, 10, folders[1].priority)
+	assert.Equal(t, []string{"concepts"}, folders[1].dependsOn)
+	assert.Equal(t, []string{"content-2023.zip", "content-2024.zip"}, folders[1].archiveNames())
+}
+
+func TestLoadArchivePlanUnknownField(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "plan.yaml")
+	err := os.WriteFile(fileName, []byte("archives:\n  - name: all\n    folder: content\n"), 0644)
+	assert.NoError(t, err)
+
+	_, err = loadArchivePlan(fileName, testPlanDefaults)
+	assert.Error(t, err)
+}
+
+func TestArchivePlanValidation(t *testing.T) {
+	all := selectorSpec{Type: allFilesSelectorName}
+	negative := -1
+	tests := []struct {
+		name string
+		spec archiveSpec
+	}{
+		{"missing name", archiveSpec{Source: "content", Selector: all}},
+		{"missing source", archiveSpec{Name: "all", Selector: all}},
+		{"invalid name template", archiveSpec{Name: "FT-{{.Year", Source: "content", Selector: all}},
+		{"unknown name field", archiveSpec{Name: "FT-{{.Week}}", Source: "content", Selector: all}},
+		{"unknown format", archiveSpec{Name: "all", Source: "content", Selector: all, Format: "rar"}},
+		{"unknown selector", archiveSpec{Name: "all", Source: "content", Selector: selectorSpec{Type: "week"}}},
+		{"year without from", archiveSpec{Name: "FT-{{.Year}}", Source: "content", Selector: selectorSpec{Type: yearSelectorName}}},
+		{"year from after to", archiveSpec{Name: "FT-{{.Year}}", Source: "content", Selector: selectorSpec{Type: yearSelectorName, From: 2018, To: 2017}}},
+		{"year not in name", archiveSpec{Name: "FT-yearly", Source: "content", Selector: selectorSpec{Type: yearSelectorName, From: 2016, To: 2017}}},
+		{"invalid window", archiveSpec{Name: "recent", Source: "content", Selector: selectorSpec{Type: rollingWindowSelectorName, Window: "a month"}}},
+		{"negative window", archiveSpec{Name: "recent", Source: "content", Selector: selectorSpec{Type: rollingWindowSelectorName, Window: "-7d"}}},
+		{"invalid range", archiveSpec{Name: "range", Source: "content", Selector: selectorSpec{Type: dateRangeSelectorName, Start: "2016-05-01", End: "2016-13-01"}}},
+		{"range ends before start", archiveSpec{Name: "range", Source: "content", Selector: selectorSpec{Type: dateRangeSelectorName, Start: "2016-05-01", End: "2016-04-30"}}},
+		{"missing pattern", archiveSpec{Name: "videos", Source: "content", Selector: selectorSpec{Type: globSelectorName}}},
+		{"invalid pattern", archiveSpec{Name: "videos", Source: "content", Selector: selectorSpec{Type: globSelectorName, Pattern: "video_[2016"}}},
+		{"negative error budget", archiveSpec{Name: "all", Source: "content", Selector: all, MaxUnreadableFiles: &negative}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := &archivePlan{Archives: []archiveSpec{test.spec}}
+			_, err := plan.zipConfigs(context.Background(), time.Now(), testPlanDefaults, nil)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestArchivePlanDuplicateArchives(t *testing.T) {
+	plan := &archivePlan{
+		Archives: []archiveSpec{
+			{Name: "all", Source: "content", Selector: selectorSpec{Type: allFilesSelectorName}},
+			{Name: "all", Source: "concepts", Selector: selectorSpec{Type: allFilesSelectorName}},
+		},
+	}
+
+	_, err := plan.zipConfigs(context.Background(), time.Now(), testPlanDefaults, nil)
+	assert.Error(t, err)
+
+	plan.Archives[1].Destination = "concept-archives"
+	_, err = plan.zipConfigs(context.Background(), time.Now(), testPlanDefaults, nil)
+	assert.NoError(t, err)
+}
+
+func TestArchivePlanUnusedSource(t *testing.T) {
+	plan := &archivePlan{
+		Sources: map[string]sourceSpec{
+			"content":    {Priority: 10},
+			"content-v2": {DateExtraction: dateExtractionSpec{Type: hivePathExtractorName}},
+		},
+		Archives: []archiveSpec{
+			{Name: "all", Source: "content", Selector: selectorSpec{Type: allFilesSelectorName}},
+		},
+	}
+
+	_, err := plan.zipConfigs(context.Background(), time.Now(), testPlanDefaults, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "content-v2")
+}
+
+func TestArchivePlanSourceDateExtractor(t *testing.T) {
+	plan := &archivePlan{
+		Sources: map[string]sourceSpec{
+			"content-v2": {DateExtraction: dateExtractionSpec{Type: hivePathExtractorName}},
+		},
+	}
+
+	extractDate, err := plan.sourceDateExtractor(context.Background(), "content-v2", nil)
+	assert.NoError(t, err)
+	date, err := extractDate("content-v2/2024/05/03/uuid.json")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, time.May, 3, 0, 0, 0, 0, time.UTC), date)
+
+	extractDate, err = plan.sourceDateExtractor(context.Background(), "content", nil)
+	assert.NoError(t, err)
+	date, err = extractDate("content/uuid_2016-10-30.json")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2016, time.October, 30, 0, 0, 0, 0, time.UTC), date)
+}
+
+func TestParseWindow(t *testing.T) {
+	window, err := parseWindow("30d")
+	assert.NoError(t, err)
+	assert.Equal(t, 30*24*time.Hour, window)
+
+	window, err = parseWindow("36h")
+	assert.NoError(t, err)
+	assert.Equal(t, 36*time.Hour, window)
+
+	_, err = parseWindow("0d")
+	assert.Error(t, err)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// runReportNameFormat is the name of the report of a run, formatted with the start time of the run.
+const runReportNameFormat = "FT-archive-run-report-%s.json"
+
+// runReportUploadTimeout bounds the upload of the run report, which goes on after the run has been cancelled,
+// e.g. by a SIGTERM, since the report of an interrupted run is the one which is needed the most.
+const runReportUploadTimeout = time.Minute
+
+// runReport lists the outcome of every archive and the files which have not been added
+// to the archives they belong to. It is uploaded to the archives folder at the end of every run.
+type runReport struct {
+	mu          sync.Mutex
+	StartTime   time.Time        `json:"startTime"`
+	ToolVersion string           `json:"toolVersion"`
+	Summary     runSummary       `json:"summary"`
+	Archives    []archiveSummary `json:"archives"`
+	SkippedKeys []skippedKey     `json:"skippedKeys"`
+}
+
+// runSummary counts the archives by their status.
+type runSummary struct {
+	Succeeded int `json:"succeeded"`
+	Skipped   int `json:"skipped"`
+	Failed    int `json:"failed"`
+}
+
+type archiveSummary struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Reason tells why the archive has been skipped.
+	Reason              string `json:"reason,omitempty"`
+	Error               string `json:"error,omitempty"`
+	Duration            string `json:"duration"`
+	NoOfZippedFiles     int    `json:"noOfZippedFiles"`
+	NoOfReusedFiles     int    `json:"noOfReusedFiles"`
+	NoOfUnreadableFiles int    `json:"noOfUnreadableFiles"`
+	// Sinks tell whether the archive has been published to the destination and to every mirror.
+	Sinks []sinkSummary `json:"sinks,omitempty"`
+}
+
+type sinkSummary struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type skippedKey struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+	// CollectedIn lists the catch-all archives the file has been added to instead.
+	CollectedIn []string `json:"collectedIn,omitempty"`
+}
+
+func newRunReport(startTime time.Time) *runReport {
+	return &runReport{
+		StartTime:   startTime.UTC(),
+		ToolVersion: version,
+		Archives:    []archiveSummary{},
+		SkippedKeys: []skippedKey{},
+	}
+}
+
+// addSkippedKey records a skipped file. Files can be skipped without a report, e.g. by the range subcommand.
+func (r *runReport) addSkippedKey(key string, reason error, collectedIn []string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.SkippedKeys = append(r.SkippedKeys, skippedKey{
+		Key:         key,
+		Reason:      reason.Error(),
+		CollectedIn: collectedIn,
+	})
+}
+
+// addArchiveResults records the results of the archives of the run.
+func (r *runReport) addArchiveResults(results []archiveResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, result := range results {
+		summary := archiveSummary{
+			Name:                result.name,
+			Status:              result.status,
+			Reason:              result.reason,
+			Duration:            result.duration.String(),
+			NoOfZippedFiles:     result.noOfZippedFiles,
+			NoOfReusedFiles:     result.noOfReusedFiles,
+			NoOfUnreadableFiles: result.noOfUnreadableFiles,
+		}
+		if result.err != nil {
+			summary.Error = result.err.Error()
+		}
+		for _, sink := range result.sinks {
+			sinkSummary := sinkSummary{Name: sink.name, Status: archiveSucceeded}
+			if sink.err != nil {
+				sinkSummary.Status = archiveFailed
+				sinkSummary.Error = sink.err.Error()
+			}
+			summary.Sinks = append(summary.Sinks, sinkSummary)
+		}
+		r.Archives = append(r.Archives, summary)
+	}
+	r.Summary = summarizeResults(results)
+}
+
+func (r *runReport) fileName() string {
+	return fmt.Sprintf(runReportNameFormat, r.StartTime.Format("20060102T150405Z"))
+}
+
+func uploadRunReport(ctx context.Context, s3Config *s3Config, report *runReport) error {
+	report.mu.Lock()
+	data, err := json.MarshalIndent(report, "", "  ")
+	report.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), runReportUploadTimeout)
+	defer cancel()
+
+	return s3Config.uploadSidecarFile(ctx, report.fileName(), data, "application/json")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadRunReport(t *testing.T) {
+	mockClient := &mockS3Client{}
+	s3Config := newS3Config(mockClient, "test-bucket", "archives")
+	report := newRunReport(time.Date(2024, time.May, 3, 10, 0, 0, 0, time.UTC))
+	report.addSkippedKey("content/undated.json", errors.New("cannot extract date"), []string{"FT-archive-undated.zip"})
+
+	err := uploadRunReport(context.Background(), s3Config, report)
+	assert.NoError(t, err)
+
+	data, _, ok := mockClient.storedObject("archives/FT-archive-run-report-20240503T100000Z.json")
+	assert.True(t, ok)
+
+	uploaded := &runReport{}
+	err = json.Unmarshal(data, uploaded)
+	assert.NoError(t, err)
+	assert.Equal(t, []skippedKey{{
+		Key:         "content/undated.json",
+		Reason:      "cannot extract date",
+		CollectedIn: []string{"FT-archive-undated.zip"},
+	}}, uploaded.SkippedKeys)
+}
+
+func TestUploadRunReportAfterCancellation(t *testing.T) {
+	mockClient := &mockS3Client{}
+	s3Config := newS3Config(mockClient, "test-bucket", "archives")
+	report := newRunReport(time.Date(2024, time.May, 3, 10, 0, 0, 0, time.UTC))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := uploadRunReport(ctx, s3Config, report)
+	assert.NoError(t, err)
+
+	_, _, ok := mockClient.storedObject("archives/FT-archive-run-report-20240503T100000Z.json")
+	assert.True(t, ok)
+}
+
+func TestRunReportArchiveResults(t *testing.T) {
+	report := newRunReport(time.Now())
+	report.addArchiveResults([]archiveResult{
+		{name: "FT-archive-2016.zip", status: archiveSucceeded, noOfZippedFiles: 10, noOfUnreadableFiles: 1},
+		{name: "FT-archive-2017.zip", status: archiveFailed, err: errors.New("cannot upload")},
+		{name: "FT-archive-2018.zip", status: archiveSkipped, reason: "source files have not changed"},
+		{name: "FT-archive-2019.zip", status: archiveSucceeded},
+	})
+
+	assert.Equal(t, runSummary{Succeeded: 2, Skipped: 1, Failed: 1}, report.Summary)
+	assert.Len(t, report.Archives, 4)
+	assert.Equal(t, 1, report.Archives[0].NoOfUnreadableFiles)
+	assert.Equal(t, "cannot upload", report.Archives[1].Error)
+	assert.Equal(t, "source files have not changed", report.Archives[2].Reason)
+}
+
+func TestRunReportWithoutReport(t *testing.T) {
+	var report *runReport
+	report.addSkippedKey("content/undated.json", errors.New("cannot extract date"), nil)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRetryInitialInterval   = 200 * time.Millisecond
+	defaultRetryThrottledInterval = time.Second
+	defaultRetryMaxInterval       = 20 * time.Second
+	defaultRetryMaxElapsedTime    = 2 * time.Minute
+)
+
+// The reasons an s3 call has failed for.
+const (
+	// retryReasonThrottled is returned when s3 asks to slow down, the call is retried after a longer wait.
+	retryReasonThrottled = "throttled"
+	// retryReasonTransient is returned for server and network errors, the call is retried.
+	retryReasonTransient = "transient"
+	// retryReasonPermanent is returned for errors which a retry cannot fix, e.g. AccessDenied or NoSuchKey.
+	retryReasonPermanent = "permanent"
+)
+
+// throttlingErrorCodes are the error codes s3 and the sdk use when requests are sent too fast.
+var throttlingErrorCodes = map[string]bool{
+	"SlowDown":                 true,
+	"Throttling":               true,
+	"ThrottlingException":      true,
+	"RequestLimitExceeded":     true,
+	"RequestThrottled":         true,
+	"TooManyRequestsException": true,
+}
+
+// transientErrorCodes are the error codes of failures which usually go away when the call is retried.
+var transientErrorCodes = map[string]bool{
+	request.ErrCodeRequestError:    true,
+	request.ErrCodeResponseTimeout: true,
+	request.ErrCodeSerialization:   true,
+	request.ErrCodeRead:            true,
+	"RequestTimeout":               true,
+	"InternalError":                true,
+}
+
+// retryPolicy retries the s3 calls which fail with throttling or transient errors.
+// It waits with exponential backoff and jitter between the attempts and gives up
+// once the next attempt would start after maxElapsedTime.
+// The retries of the aws sdk are turned off, so this is the only retry mechanism.
+type retryPolicy struct {
+	initialInterval time.Duration
+	// throttledInterval is the first wait after s3 has asked to slow down.
+	throttledInterval time.Duration
+	maxInterval       time.Duration
+	maxElapsedTime    time.Duration
+}
+
+func newRetryPolicy(maxElapsedTime time.Duration) *retryPolicy {
+	return &retryPolicy{
+		initialInterval:   defaultRetryInitialInterval,
+		throttledInterval: defaultRetryThrottledInterval,
+		maxInterval:       defaultRetryMaxInterval,
+		maxElapsedTime:    maxElapsedTime,
+	}
+}
+
+// do calls fn until it succeeds, fails with a permanent error, the context is cancelled
+// or the max elapsed time is reached. It returns the error of the last attempt.
+func (p *retryPolicy) do(ctx context.Context, operation string, fn func() error) error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		reason := classifyError(err)
+		entry := log.WithError(err).WithFields(log.Fields{
+			"operation": operation,
+			"attempt":   attempt,
+			"reason":    reason,
+		})
+		if reason == retryReasonPermanent || ctx.Err() != nil {
+			entry.Debug("S3 call failed, it is not retried")
+			return err
+		}
+
+		wait := p.backoff(attempt, reason)
+		if time.Since(start)+wait > p.maxElapsedTime {
+			entry.Errorf("S3 call failed, giving up after %s", time.Since(start).Round(time.Millisecond))
+			return err
+		}
+
+		entry.WithField("wait", wait.String()).Warn("S3 call failed, retrying")
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// backoff doubles the wait with every attempt up to maxInterval.
+// Half of the wait is random, so the calls which failed at the same time are not retried at the same time.
+func (p *retryPolicy) backoff(attempt int, reason string) time.Duration {
+	interval := p.initialInterval
+	if reason == retryReasonThrottled {
+		interval = p.throttledInterval
+	}
+	for i := 1; i < attempt && interval < p.maxInterval; i++ {
+		interval *= 2
+	}
+	if interval > p.maxInterval {
+		interval = p.maxInterval
+	}
+
+	half := interval / 2
+	return half + time.Duration(rand.Int63n(int64(interval-half)+1))
+}
+
+// classifyError tells whether the call which failed with err is worth retrying.
+// Errors which do not come from s3, e.g. a connection reset while the body is read, are transient.
+func classifyError(err error) string {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return retryReasonPermanent
+	}
+
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return retryReasonTransient
+	}
+
+	switch {
+	case aerr.Code() == request.CanceledErrorCode:
+		return retryReasonPermanent
+	case throttlingErrorCodes[aerr.Code()]:
+		return retryReasonThrottled
+	case transientErrorCodes[aerr.Code()]:
+		return retryReasonTransient
+	}
+
+	var rerr awserr.RequestFailure
+	if errors.As(err, &rerr) {
+		switch status := rerr.StatusCode(); {
+		case status == 503 || status == 429:
+			return retryReasonThrottled
+		case status >= 500:
+			return retryReasonTransient
+		}
+	}
+
+	return retryReasonPermanent
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestRetryPolicy retries within milliseconds, so tests of failing calls stay fast.
+func newTestRetryPolicy() *retryPolicy {
+	return &retryPolicy{
+		initialInterval:   time.Millisecond,
+		throttledInterval: 2 * time.Millisecond,
+		maxInterval:       5 * time.Millisecond,
+		maxElapsedTime:    50 * time.Millisecond,
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := map[string]struct {
+		err  error
+		want string
+	}{
+		"SlowDown": {
+			err:  awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, ""),
+			want: retryReasonThrottled,
+		},
+		"ServiceUnavailable": {
+			err:  awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "Service Unavailable", nil), 503, ""),
+			want: retryReasonThrottled,
+		},
+		"InternalError": {
+			err:  awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error.", nil), 500, ""),
+			want: retryReasonTransient,
+		},
+		"RequestError": {
+			err:  awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("connection reset by peer")),
+			want: retryReasonTransient,
+		},
+		"ConnectionReset": {
+			err:  fmt.Errorf("reading body: %w", errors.New("connection reset by peer")),
+			want: retryReasonTransient,
+		},
+		"AccessDenied": {
+			err:  awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, ""),
+			want: retryReasonPermanent,
+		},
+		"NoSuchKey": {
+			err:  fmt.Errorf("downloading file: %w", awserr.NewRequestFailure(awserr.New("NoSuchKey", "The specified key does not exist.", nil), 404, "")),
+			want: retryReasonPermanent,
+		},
+		"Canceled": {
+			err:  awserr.New(request.CanceledErrorCode, "request context canceled", context.Canceled),
+			want: retryReasonPermanent,
+		},
+		"ContextCanceled": {
+			err:  context.Canceled,
+			want: retryReasonPermanent,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.want, classifyError(test.err))
+		})
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	slowDown := awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, "")
+	accessDenied := awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "")
+
+	tests := map[string]struct {
+		errs         []error
+		wantErr      bool
+		wantAttempts int
+	}{
+		"Success": {
+			wantAttempts: 1,
+		},
+		"ThrottledThenSuccess": {
+			errs:         []error{slowDown, slowDown},
+			wantAttempts: 3,
+		},
+		"Permanent": {
+			errs:         []error{accessDenied, accessDenied},
+			wantErr:      true,
+			wantAttempts: 1,
+		},
+		"ThrottledThenPermanent": {
+			errs:         []error{slowDown, accessDenied},
+			wantErr:      true,
+			wantAttempts: 2,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			attempts := 0
+			err := newTestRetryPolicy().do(context.Background(), "get test-folder/file1.txt", func() error {
+				attempts++
+				if attempts <= len(test.errs) {
+					return test.errs[attempts-1]
+				}
+				return nil
+			})
+
+			assert.Equal(t, test.wantErr, err != nil)
+			assert.Equal(t, test.wantAttempts, attempts)
+		})
+	}
+}
+
+func TestRetryPolicyDoGivesUpAfterMaxElapsedTime(t *testing.T) {
+	policy := newTestRetryPolicy()
+	internalError := awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error.", nil), 500, "")
+
+	start := time.Now()
+	attempts := 0
+	err := policy.do(context.Background(), "put archives/FT-archive-2016.zip", func() error {
+		attempts++
+		return internalError
+	})
+
+	assert.Equal(t, internalError, err)
+	assert.True(t, attempts > 1)
+	assert.True(t, time.Since(start) <= policy.maxElapsedTime+10*time.Millisecond)
+}
+
+func TestRetryPolicyDoCancelled(t *testing.T) {
+	policy := newRetryPolicy(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	attempts := 0
+	err := policy.do(ctx, "list test-folder", func() error {
+		attempts++
+		cancel()
+		return awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, "")
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := newRetryPolicy(time.Minute)
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		wait := policy.backoff(attempt, retryReasonTransient)
+		assert.True(t, wait <= policy.maxInterval)
+		assert.True(t, wait >= min(policy.initialInterval<<(attempt-1), policy.maxInterval)/2)
+	}
+
+	assert.True(t, policy.backoff(1, retryReasonThrottled) >= policy.throttledInterval/2)
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// archiveRouter builds several archives from the same list of files in a single pass.
+// Every file key is run through the selectors of all the registered archives once,
+// the file is downloaded once and then written into every archive which selected it.
+type archiveRouter struct {
+	s3Config *s3Config
+	archives []*routedArchive
+	files    []*fileInfo
+	routes   [][]*routedArchive
+	// report records the files which cannot be selected or downloaded, it can be nil.
+	report *runReport
+	// checkpoints saves the progress of the zip archives regularly, it can be nil.
+	checkpoints *checkpointer
+}
+
+type routedArchive struct {
+	zipConfig *zipConfig
+	// destination is the location the archive and its sidecar files are uploaded to.
+	destination *s3Config
+	w           io.Writer
+	writer      archiveWriter
+	files       []*fileInfo
+	sourceState sourceState
+	skipped     bool
+	previous    *previousArchive
+	// resume is the checkpoint of a previous run the archive is continued from.
+	resume *archiveCheckpoint
+	// checkpointed tells whether the archive can be continued from a checkpoint if the run fails.
+	checkpointed bool
+	// err is the error the archive has failed with, the other archives are still built.
+	err      error
+	manifest *archiveManifest
+	// noOfHandledFiles is the number of selected files which have been handled, whether they have been written or left out.
+	noOfHandledFiles int
+	// noOfZippedFiles is the number of files which have been written to the archive.
+	noOfZippedFiles int
+	noOfReusedFiles int
+	// noOfUnreadableFiles is the number of files which have been left out because they cannot be downloaded.
+	noOfUnreadableFiles int
+}
+
+// fileRoute tells which archives need the downloaded file
+// and which can copy it from their previous version.
+type fileRoute struct {
+	file      *fileInfo
+	downloads []*routedArchive
+	copies    []*routedArchive
+}
+
+func newArchiveRouter(s3Config *s3Config) *archiveRouter {
+	return &archiveRouter{
+		s3Config: s3Config,
+	}
+}
+
+// addArchive registers an archive which will be written to w when the files are routed.
+func (r *archiveRouter) addArchive(zipConfig *zipConfig, w io.Writer) *routedArchive {
+	archive := &routedArchive{
+		zipConfig: zipConfig,
+		w:         w,
+		manifest:  newArchiveManifest(zipConfig),
+	}
+	r.archives = append(r.archives, archive)
+	return archive
+}
+
+// route adds the provided files to all the archives which selected them
+// and finishes the archives.
+func (r *archiveRouter) route(ctx context.Context, files []*fileInfo) error {
+	r.selectFiles(files)
+	return r.write(ctx)
+}
+
+// selectFiles runs the provided files through the selectors of all the archives.
+// Afterwards every archive knows its files and their source state,
+// so archives which do not have to be rebuilt can be skipped before anything is downloaded.
+// The files are selected by a bounded pool of workers, as the selectors may have to read the publish dates
+// from the metadata or the body of the files, but the archives get their files in the order of the keys.
+func (r *archiveRouter) selectFiles(files []*fileInfo) {
+	selections := r.selectAllArchives(files)
+
+	r.files = make([]*fileInfo, 0, len(files))
+	r.routes = make([][]*routedArchive, 0, len(files))
+	for i, file := range files {
+		archives, selectErr := selections[i].archives, selections[i].err
+		if selectErr != nil {
+			r.reportUnselectedFile(file.key, selectErr)
+		}
+		if len(archives) == 0 {
+			continue
+		}
+
+		for _, archive := range archives {
+			archive.files = append(archive.files, file)
+		}
+		r.files = append(r.files, file)
+		r.routes = append(r.routes, archives)
+	}
+
+	for _, archive := range r.archives {
+		archive.sourceState = newSourceState(archive.files)
+		archive.manifest.SourceFingerprint = archive.sourceState.fingerprint
+	}
+}
+
+// fileSelection is the outcome of running a file through the selectors of all the archives.
+type fileSelection struct {
+	archives []*routedArchive
+	err      error
+}
+
+// selectAllArchives selects the archives of every file with the download workers of the source.
+func (r *archiveRouter) selectAllArchives(files []*fileInfo) []fileSelection {
+	noOfWorkers := r.s3Config.downloadWorkers
+	if noOfWorkers < 1 {
+		noOfWorkers = 1
+	}
+
+	selections := make([]fileSelection, len(files))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < noOfWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				archives, err := r.selectArchives(files[i].key)
+				selections[i] = fileSelection{archives: archives, err: err}
+			}
+		}()
+	}
+
+	for i := range files {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return selections
+}
+
+// only returns a router which writes the provided archives of r with the files they have selected.
+func (r *archiveRouter) only(archives []*routedArchive) *archiveRouter {
+	included := make(map[*routedArchive]bool, len(archives))
+	for _, archive := range archives {
+		included[archive] = true
+	}
+
+	only := &archiveRouter{
+		s3Config:    r.s3Config,
+		archives:    archives,
+		report:      r.report,
+		checkpoints: r.checkpoints,
+	}
+	for i, file := range r.files {
+		var routes []*routedArchive
+		for _, archive := range r.routes[i] {
+			if included[archive] {
+				routes = append(routes, archive)
+			}
+		}
+		if len(routes) > 0 {
+			only.files = append(only.files, file)
+			only.routes = append(only.routes, routes)
+		}
+	}
+
+	return only
+}
+
+// write downloads the selected files and adds them to the archives which have not been skipped.
+// An archive which cannot be written fails on its own, the other archives are still built.
+// It stops as soon as the context is cancelled.
+func (r *archiveRouter) write(ctx context.Context) error {
+	startTime := time.Now()
+	for _, archive := range r.archives {
+		if archive.skipped {
+			continue
+		}
+
+		if archive.resume != nil {
+			log.Infof("Resuming to zip files into archive with name %s after %d files", archive.zipConfig.zipName, archive.resume.NoOfHandledFiles)
+			writer, err := newResumedZipArchiveWriter(archive.w, archive.resume.Headers)
+			if err != nil {
+				archive.fail(fmt.Errorf("cannot resume archive %s: %w", archive.zipConfig.zipName, err))
+				continue
+			}
+			archive.writer = writer
+			continue
+		}
+
+		log.Infof("Starting to zip files into archive with name %s", archive.zipConfig.zipName)
+		writer, err := archive.zipConfig.format.newWriter(archive.w)
+		if err != nil {
+			archive.fail(fmt.Errorf("cannot create archive %s: %w", archive.zipConfig.zipName, err))
+			continue
+		}
+		archive.writer = writer
+	}
+
+	fileKeys := make([]string, 0, len(r.files))
+	routes := make([]fileRoute, 0, len(r.files))
+	positions := make(map[*routedArchive]int, len(r.archives))
+	for i, file := range r.files {
+		route := fileRoute{file: file}
+		for _, archive := range r.routes[i] {
+			if !archive.active() {
+				continue
+			}
+
+			//the files which have been handled before the checkpoint are already in the archive
+			positions[archive]++
+			if archive.resume != nil && positions[archive] <= archive.resume.NoOfHandledFiles {
+				continue
+			}
+
+			if archive.previous.reusableEntry(file) != nil {
+				route.copies = append(route.copies, archive)
+			} else {
+				route.downloads = append(route.downloads, archive)
+			}
+		}
+
+		if len(route.downloads) > 0 {
+			fileKeys = append(fileKeys, file.key)
+		} else if len(route.copies) == 0 {
+			continue
+		}
+		routes = append(routes, route)
+	}
+
+	//files are downloaded in parallel, but added to the archives in the order of the keys
+	downloadedFiles, stopDownloads := r.s3Config.downloadFiles(ctx, fileKeys)
+	defer stopDownloads()
+
+	for i, route := range routes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if i > 0 && r.checkpoints.due() {
+			r.saveCheckpoints(ctx, routes[i-1].file.key)
+		}
+
+		for _, archive := range route.copies {
+			if !archive.active() {
+				continue
+			}
+
+			archive.noOfHandledFiles++
+			err := archive.copyFile(route.file)
+			if err != nil {
+				archive.fail(fmt.Errorf("cannot copy file with name %s from the existing archive %s: %w", route.file.key, archive.zipConfig.zipName, err))
+			}
+		}
+
+		if len(route.downloads) == 0 {
+			continue
+		}
+
+		s3File := <-downloadedFiles
+		for _, archive := range route.downloads {
+			archive.noOfHandledFiles++
+		}
+
+		if s3File.err != nil {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if isNotFound(s3File.err) {
+				log.Infof("File with name %s was deleted since the zip up process started", s3File.key)
+				r.report.addSkippedKey(s3File.key, s3File.err, nil)
+				continue
+			}
+
+			r.skipUnreadableFile(route, s3File)
+			continue
+		}
+
+		for _, archive := range route.downloads {
+			if !archive.active() {
+				continue
+			}
+
+			err := archive.addFile(route.file, s3File)
+			if err != nil {
+				archive.fail(fmt.Errorf("cannot add file with name %s to archive %s: %w", s3File.key, archive.zipConfig.zipName, err))
+			}
+		}
+	}
+
+	for _, archive := range r.archives {
+		if !archive.active() {
+			continue
+		}
+
+		//the archive is described by the files it holds, so the next run tops up an archive which misses files
+		archive.sourceState = archive.writtenSourceState()
+		archive.manifest.SourceFingerprint = archive.sourceState.fingerprint
+		archive.manifest.BuildTime = startTime.UTC()
+		if archive.zipConfig.format.embedsManifest {
+			err := archive.addManifest()
+			if err != nil {
+				archive.fail(fmt.Errorf("cannot add manifest to zip archive %s: %w", archive.zipConfig.zipName, err))
+				continue
+			}
+		}
+
+		err := archive.writer.Close()
+		if err != nil {
+			archive.fail(fmt.Errorf("cannot finish zip archive %s: %w", archive.zipConfig.zipName, err))
+			continue
+		}
+
+		log.Infof("Finished zip creation process for zip with name %s. Duration: %s. Number of zipped files is: %d, %d of them reused from the existing archive", archive.zipConfig.zipName, time.Since(startTime), archive.noOfZippedFiles, archive.noOfReusedFiles)
+	}
+
+	return nil
+}
+
+// saveCheckpoints saves the progress of the zip archives which are uploaded to s3.
+// A failed checkpoint does not stop the run, the archive can be resumed from its previous checkpoint.
+func (r *archiveRouter) saveCheckpoints(ctx context.Context, lastKey string) {
+	for _, archive := range r.archives {
+		if !archive.active() {
+			continue
+		}
+
+		err := archive.saveCheckpoint(ctx, r.checkpoints.store, lastKey)
+		if err != nil {
+			log.WithError(err).Warnf("Cannot save checkpoint of archive %s", archive.zipConfig.zipName)
+			continue
+		}
+		archive.checkpointed = true
+	}
+	r.checkpoints.last = time.Now()
+}
+
+// skipUnreadableFile leaves a file which cannot be downloaded out of the archives which need it.
+// Archives which have run out of their error budget fail instead.
+func (r *archiveRouter) skipUnreadableFile(route fileRoute, s3File *downloadedFile) {
+	skipped := false
+	for _, archive := range route.downloads {
+		if !archive.active() {
+			continue
+		}
+
+		archive.noOfUnreadableFiles++
+		if archive.noOfUnreadableFiles > archive.zipConfig.maxUnreadableFiles {
+			archive.fail(fmt.Errorf("cannot download file with name %s from s3, %d files of the archive cannot be downloaded: %w", s3File.key, archive.noOfUnreadableFiles, s3File.err))
+			continue
+		}
+
+		log.WithError(s3File.err).Warnf("Cannot download file with name %s, it is left out of archive %s", s3File.key, archive.zipConfig.zipName)
+		skipped = true
+	}
+
+	if skipped {
+		r.report.addSkippedKey(s3File.key, s3File.err, nil)
+	}
+}
+
+// selectArchives returns the archives which select the file.
+// Files which some of the selectors fail on, e.g. because their date cannot be extracted,
+// are added to the catch-all undated archives, the error of the failed selector is returned with them.
+func (r *archiveRouter) selectArchives(s3ObjectKey string) ([]*routedArchive, error) {
+	var archives []*routedArchive
+	var undatedArchives []*routedArchive
+	var selectErr error
+	for _, archive := range r.archives {
+		zipConfig := archive.zipConfig
+		if zipConfig.selectorName == undatedSelectorName {
+			undatedArchives = append(undatedArchives, archive)
+			continue
+		}
+
+		if zipConfig.fileSelectorFn != nil {
+			isEligible, err := zipConfig.fileSelectorFn(s3ObjectKey)
+			if err != nil {
+				log.WithError(err).Debugf("cannot select S3 object with key %s for archive %s.", s3ObjectKey, zipConfig.zipName)
+				selectErr = err
+				continue
+			}
+
+			if !isEligible {
+				continue
+			}
+		}
+
+		archives = append(archives, archive)
+	}
+
+	if selectErr != nil {
+		archives = append(archives, undatedArchives...)
+	}
+
+	return archives, selectErr
+}
+
+// reportUnselectedFile records a file which some of the selectors have failed on, with the undated archives it is added to.
+func (r *archiveRouter) reportUnselectedFile(s3ObjectKey string, selectErr error) {
+	var collectedIn []string
+	for _, archive := range r.archives {
+		if archive.zipConfig.selectorName == undatedSelectorName {
+			collectedIn = append(collectedIn, archive.zipConfig.zipName)
+		}
+	}
+	if len(collectedIn) == 0 {
+		log.WithError(selectErr).Errorf("cannot select S3 object with key %s.", s3ObjectKey)
+	} else {
+		log.WithError(selectErr).Errorf("cannot select S3 object with key %s, it is added to the undated archives %v.", s3ObjectKey, collectedIn)
+	}
+	r.report.addSkippedKey(s3ObjectKey, selectErr, collectedIn)
+}
+
+// active tells whether files are still added to the archive, i.e. it has neither been skipped nor failed.
+func (a *routedArchive) active() bool {
+	return !a.skipped && a.err == nil
+}
+
+func (a *routedArchive) fail(err error) {
+	log.WithError(err).Errorf("Archive with name %s has failed, the other archives are still built", a.zipConfig.zipName)
+	a.err = err
+}
+
+func (a *routedArchive) addFile(file *fileInfo, s3File *downloadedFile) error {
+	fileNameSplit := strings.Split(s3File.key, "/")
+	fileName := s3File.key
+	if len(fileNameSplit) > 0 {
+		fileName = fileNameSplit[len(fileNameSplit)-1]
+	}
+
+	err := a.writer.addEntry(fileName, file.lastModified, s3File.data)
+	if err != nil {
+		return fmt.Errorf("cannot add file to archive: %s", err)
+	}
+
+	a.manifest.Entries = append(a.manifest.Entries, newManifestEntry(fileName, file, s3File.data, a.zipConfig.extractDate))
+	a.noOfZippedFiles++
+	return nil
+}
+
+// copyFile copies the compressed entry of the file from the previous version of the archive.
+// Only zip archives have a previous version.
+func (a *routedArchive) copyFile(file *fileInfo) error {
+	entry := a.previous.reusableEntry(file)
+
+	err := a.writer.(*zipArchiveWriter).copyEntry(entry.file)
+	if err != nil {
+		return err
+	}
+
+	a.manifest.Entries = append(a.manifest.Entries, entry.manifestEntry)
+	a.noOfZippedFiles++
+	a.noOfReusedFiles++
+	return nil
+}
+
+// writtenSourceState describes the selected files which have been written to the archive,
+// without the ones which have been left out because they could not be downloaded.
+func (a *routedArchive) writtenSourceState() sourceState {
+	written := make(map[string]bool, len(a.manifest.Entries))
+	for _, entry := range a.manifest.Entries {
+		written[entry.Key] = true
+	}
+
+	files := make([]*fileInfo, 0, len(written))
+	for _, file := range a.files {
+		if written[file.key] {
+			files = append(files, file)
+		}
+	}
+
+	return newSourceState(files)
+}
+
+func (a *routedArchive) saveCheckpoint(ctx context.Context, store checkpointStore, lastKey string) error {
+	writer, ok := a.writer.(*zipArchiveWriter)
+	if !ok {
+		return nil
+	}
+	upload, ok := a.w.(archiveUpload)
+	if !ok {
+		return nil
+	}
+
+	err := writer.flush()
+	if err != nil {
+		return err
+	}
+
+	uploadCheckpoint, err := upload.checkpoint()
+	if err != nil {
+		return err
+	}
+
+	return store.save(ctx, &archiveCheckpoint{
+		ArchiveKey:         upload.archiveKey(),
+		HandledFingerprint: newSourceState(a.files[:a.noOfHandledFiles]).fingerprint,
+		Time:               time.Now().UTC(),
+		NoOfHandledFiles:   a.noOfHandledFiles,
+		NoOfZippedFiles:    a.noOfZippedFiles,
+		NoOfReusedFiles:    a.noOfReusedFiles,
+		LastKey:            lastKey,
+		Headers:            writer.headers,
+		Entries:            a.manifest.Entries,
+		Upload:             uploadCheckpoint,
+	})
+}
+
+// resumeFrom continues the archive from the checkpoint of a previous run.
+func (a *routedArchive) resumeFrom(checkpoint *archiveCheckpoint) {
+	a.resume = checkpoint
+	a.checkpointed = true
+	a.noOfHandledFiles = checkpoint.NoOfHandledFiles
+	a.noOfZippedFiles = checkpoint.NoOfZippedFiles
+	a.noOfReusedFiles = checkpoint.NoOfReusedFiles
+	a.manifest.Entries = append(a.manifest.Entries, checkpoint.Entries...)
+}
+
+func (a *routedArchive) addManifest() error {
+	data, err := json.MarshalIndent(a.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return a.writer.addEntry(manifestEntryName, a.manifest.BuildTime, data)
+}
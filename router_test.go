@@ -0,0 +1,141 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteDownloadsEveryFileOnce(t *testing.T) {
+	fileKeys := []string{
+		fmt.Sprintf("test-folder/%s_2016-10-30.json", contentUUID),
+		fmt.Sprintf("test-folder/%s_2017-01-02.json", "0b2d3f6a-5b4e-11e7-9bc8-8055f264aa8b"),
+		fmt.Sprintf("test-folder/%s_2018-03-04.json", "1f0a0b6e-5b4e-11e7-9bc8-8055f264aa8b"),
+		"test-folder/undated.json",
+	}
+	mockClient := &mockS3Client{}
+	s3Config := newS3Config(mockClient, "test-bucket", "")
+
+	router := newArchiveRouter(s3Config)
+	var archive2016, archive2017, archiveAll bytes.Buffer
+	router.addArchive(newZipConfig("2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016), &archive2016)
+	router.addArchive(newZipConfig("2017", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2017), 2017), &archive2017)
+	router.addArchive(newZipConfig("all", zipFormat, allFilesSelectorName, nil, 0), &archiveAll)
+
+	files := make([]*fileInfo, 0, len(fileKeys))
+	for _, fileKey := range fileKeys {
+		files = append(files, &fileInfo{key: fileKey})
+	}
+
+	err := router.route(context.Background(), files)
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(fileKeys)), mockClient.getObjectCalls)
+	assert.Equal(t, []string{fmt.Sprintf("%s_2016-10-30.json", contentUUID), manifestEntryName}, zipEntryNames(t, archive2016.Bytes()))
+	assert.Equal(t, []string{"0b2d3f6a-5b4e-11e7-9bc8-8055f264aa8b_2017-01-02.json", manifestEntryName}, zipEntryNames(t, archive2017.Bytes()))
+	assert.Len(t, zipEntryNames(t, archiveAll.Bytes()), len(fileKeys)+1)
+
+	for i, archive := range router.archives {
+		assert.Equal(t, []int{1, 1, 4}[i], archive.noOfZippedFiles)
+	}
+}
+
+func TestRouteReusesFilesDownloadedForTheirDate(t *testing.T) {
+	mockClient := &mockS3Client{}
+	mockClient.storeObject("content/a.json", []byte(`{"publishedDate":"2016-05-01"}`), nil)
+	mockClient.storeObject("content/b.json", []byte(`{"publishedDate":"2017-06-01"}`), nil)
+	s3Config := newS3Config(mockClient, "test-bucket", "")
+	extractDate, err := newDateExtractor(context.Background(), dateExtractionSpec{JSONField: "publishedDate"}, s3Config)
+	assert.Nil(t, err)
+
+	router := newArchiveRouter(s3Config)
+	var archive2016, archive2017 bytes.Buffer
+	router.addArchive(newZipConfig("2016", zipFormat, yearSelectorName, yearSelector(extractDate, 2016), 2016), &archive2016)
+	router.addArchive(newZipConfig("2017", zipFormat, yearSelectorName, yearSelector(extractDate, 2017), 2017), &archive2017)
+
+	err = router.route(context.Background(), []*fileInfo{{key: "content/a.json"}, {key: "content/b.json"}})
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), mockClient.storedObjectGets)
+	assert.Equal(t, []string{"a.json", manifestEntryName}, zipEntryNames(t, archive2016.Bytes()))
+	assert.Equal(t, []string{"b.json", manifestEntryName}, zipEntryNames(t, archive2017.Bytes()))
+	assert.Empty(t, s3Config.prefetched.files)
+}
+
+func TestRouteCollectsUndatedFiles(t *testing.T) {
+	files := []*fileInfo{
+		{key: fmt.Sprintf("test-folder/%s_2016-10-30.json", contentUUID)},
+		{key: "test-folder/undated.json"},
+	}
+	s3Config := newS3Config(&mockS3Client{}, "test-bucket", "")
+	report := newRunReport(time.Now())
+
+	router := newArchiveRouter(s3Config)
+	router.report = report
+	var archive2016, archiveUndated bytes.Buffer
+	router.addArchive(newZipConfig("2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016), &archive2016)
+	router.addArchive(newZipConfig(undatedArchiveName, zipFormat, undatedSelectorName, nil, 0), &archiveUndated)
+
+	err := router.route(context.Background(), files)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{fmt.Sprintf("%s_2016-10-30.json", contentUUID), manifestEntryName}, zipEntryNames(t, archive2016.Bytes()))
+	assert.Equal(t, []string{"undated.json", manifestEntryName}, zipEntryNames(t, archiveUndated.Bytes()))
+	assert.Len(t, report.SkippedKeys, 1)
+	assert.Equal(t, "test-folder/undated.json", report.SkippedKeys[0].Key)
+	assert.NotEmpty(t, report.SkippedKeys[0].Reason)
+	assert.Equal(t, []string{"FT-archive-undated.zip"}, report.SkippedKeys[0].CollectedIn)
+}
+
+func TestRouteAddsManifest(t *testing.T) {
+	fileKey := fmt.Sprintf("test-folder/%s_2016-10-30.json", contentUUID)
+	s3Config := newS3Config(&mockS3Client{}, "test-bucket", "")
+
+	router := newArchiveRouter(s3Config)
+	var archive bytes.Buffer
+	router.addArchive(newZipConfig("FT-archive-2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016), &archive)
+
+	err := router.route(context.Background(), []*fileInfo{{key: fileKey, eTag: "etag"}})
+	assert.Nil(t, err)
+
+	zipReader, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	assert.Nil(t, err)
+	f, err := zipReader.Open(manifestEntryName)
+	assert.Nil(t, err)
+
+	manifest := &archiveManifest{}
+	err = json.NewDecoder(f).Decode(manifest)
+	assert.Nil(t, err)
+	assert.Equal(t, "FT-archive-2016.zip", manifest.ArchiveName)
+	assert.Equal(t, yearSelectorName, manifest.Selector)
+	assert.Equal(t, 2016, manifest.Year)
+	assert.False(t, manifest.BuildTime.IsZero())
+	assert.Equal(t, []manifestEntry{{
+		Name:        fmt.Sprintf("%s_2016-10-30.json", contentUUID),
+		Key:         fileKey,
+		ETag:        "etag",
+		Size:        int64(len(fileKey)),
+		SHA256:      fmt.Sprintf("%x", sha256.Sum256([]byte(fileKey))),
+		PublishDate: "2016-10-30",
+	}}, manifest.Entries)
+}
+
+func zipEntryNames(t *testing.T, data []byte) []string {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("cannot read zip archive: %s", err)
+	}
+
+	names := make([]string, 0, len(r.File))
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	return names
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultEndpointRegion is used for the S3 compatible stores which ignore the region, e.g. MinIO, but the sdk still needs one.
+const defaultEndpointRegion = "us-east-1"
+
+// s3ClientConfig tells how the S3 API is reached: AWS itself or an S3 compatible store
+// like MinIO, LocalStack or Ceph, e.g. for integration tests or on-prem mirrors.
+type s3ClientConfig struct {
+	region string
+	// endpoint is the URL of an S3 compatible store, AWS is used when it is empty.
+	endpoint       string
+	forcePathStyle bool
+	disableSSL     bool
+	// accessKeyID and secretAccessKey are the static credentials of the client.
+	// When they are empty, the credentials are looked up by the sdk, e.g. in the AWS_ACCESS_KEY_ID env var or the web identity token.
+	accessKeyID     string
+	secretAccessKey string
+	// roleARN is a role which is assumed with the credentials above, e.g. to access a bucket of another account.
+	roleARN string
+}
+
+func (c s3ClientConfig) awsConfig() (*aws.Config, error) {
+	//the s3 calls are retried by the retry policy of the app instead of the sdk
+	config := aws.NewConfig().WithRegion(c.region).WithMaxRetries(0)
+	if c.endpoint != "" {
+		config.WithEndpoint(c.endpoint)
+		if c.region == "" {
+			config.WithRegion(defaultEndpointRegion)
+		}
+	}
+	if c.forcePathStyle {
+		config.WithS3ForcePathStyle(true)
+	}
+	if c.disableSSL {
+		config.WithDisableSSL(true)
+	}
+
+	if (c.accessKeyID == "") != (c.secretAccessKey == "") {
+		return nil, errors.New("both the access key id and the secret access key have to be set")
+	}
+	if c.accessKeyID != "" {
+		config.WithCredentials(credentials.NewStaticCredentials(c.accessKeyID, c.secretAccessKey, ""))
+	}
+
+	return config, nil
+}
+
+// stsConfig is the config of the client which assumes the role. STS is always reached on AWS,
+// the custom endpoint and its options only apply to the S3 compatible store.
+func (c s3ClientConfig) stsConfig() (*aws.Config, error) {
+	sts := c
+	sts.endpoint = ""
+	sts.forcePathStyle = false
+	sts.disableSSL = false
+	if c.endpoint != "" && c.region == "" {
+		sts.region = defaultEndpointRegion
+	}
+
+	return sts.awsConfig()
+}
+
+func newS3Client(config s3ClientConfig) *s3.S3 {
+	awsConfig, err := config.awsConfig()
+	if err != nil {
+		log.WithError(err).Fatal("Invalid S3 client config")
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		log.WithError(err).Fatal("creating aws session")
+	}
+
+	if config.roleARN == "" {
+		return s3.New(sess)
+	}
+
+	stsConfig, err := config.stsConfig()
+	if err != nil {
+		log.WithError(err).Fatal("Invalid STS client config")
+	}
+	stsSess, err := session.NewSession(stsConfig)
+	if err != nil {
+		log.WithError(err).Fatal("creating aws session for sts")
+	}
+
+	//the assumed credentials are refreshed by the sdk before they expire, so they outlast long runs
+	return s3.New(sess, aws.NewConfig().WithCredentials(stscreds.NewCredentials(stsSess, config.roleARN)))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3ClientConfig(t *testing.T) {
+	tests := map[string]struct {
+		config        s3ClientConfig
+		wantRegion    string
+		wantEndpoint  string
+		wantPathStyle bool
+		wantNoSSL     bool
+		wantKeyID     string
+		wantErr       bool
+	}{
+		"AWS": {
+			config:     s3ClientConfig{region: "eu-west-1"},
+			wantRegion: "eu-west-1",
+		},
+		"MinIO": {
+			config:        s3ClientConfig{endpoint: "http://localhost:9000", forcePathStyle: true, disableSSL: true, accessKeyID: "minio", secretAccessKey: "minio123"},
+			wantRegion:    defaultEndpointRegion,
+			wantEndpoint:  "http://localhost:9000",
+			wantPathStyle: true,
+			wantNoSSL:     true,
+			wantKeyID:     "minio",
+		},
+		"EndpointWithRegion": {
+			config:       s3ClientConfig{region: "eu-west-1", endpoint: "https://ceph.internal"},
+			wantRegion:   "eu-west-1",
+			wantEndpoint: "https://ceph.internal",
+		},
+		"AccessKeyWithoutSecret": {
+			config:  s3ClientConfig{region: "eu-west-1", accessKeyID: "key"},
+			wantErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			config, err := test.config.awsConfig()
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.wantRegion, aws.StringValue(config.Region))
+			assert.Equal(t, test.wantEndpoint, aws.StringValue(config.Endpoint))
+			assert.Equal(t, test.wantPathStyle, aws.BoolValue(config.S3ForcePathStyle))
+			assert.Equal(t, test.wantNoSSL, aws.BoolValue(config.DisableSSL))
+			assert.Equal(t, 0, aws.IntValue(config.MaxRetries))
+			if test.wantKeyID == "" {
+				assert.Nil(t, config.Credentials)
+				return
+			}
+			value, err := config.Credentials.Get()
+			assert.Nil(t, err)
+			assert.Equal(t, test.wantKeyID, value.AccessKeyID)
+		})
+	}
+}
+
+func TestSTSConfigHasNoS3Endpoint(t *testing.T) {
+	config, err := s3ClientConfig{
+		endpoint:        "https://ceph.internal",
+		forcePathStyle:  true,
+		disableSSL:      true,
+		accessKeyID:     "key",
+		secretAccessKey: "secret",
+		roleARN:         "arn:aws:iam::123456789012:role/archives",
+	}.stsConfig()
+	assert.Nil(t, err)
+	assert.Nil(t, config.Endpoint)
+	assert.False(t, aws.BoolValue(config.S3ForcePathStyle))
+	assert.False(t, aws.BoolValue(config.DisableSSL))
+	assert.Equal(t, defaultEndpointRegion, aws.StringValue(config.Region))
+	value, err := config.Credentials.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "key", value.AccessKeyID)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	archiveSucceeded = "succeeded"
+	archiveSkipped   = "skipped"
+	archiveFailed    = "failed"
+)
+
+// archiveResult is the outcome of a single archive of a run.
+type archiveResult struct {
+	name   string
+	status string
+	// reason tells why the archive has been skipped.
+	reason          string
+	err             error
+	duration        time.Duration
+	noOfZippedFiles int
+	noOfReusedFiles int
+	// noOfUnreadableFiles is the number of files which have been left out because they cannot be downloaded.
+	noOfUnreadableFiles int
+	// sinks are the results of the destination and the mirrors the archive has been published to.
+	sinks []sinkResult
+}
+
+// job builds a group of archives, e.g. all the archives of a source folder.
+type job struct {
+	name     string
+	priority int
+	// dependsOn lists the jobs which have to finish before the job starts.
+	// If any of them fails, the job is not run and its archives are skipped.
+	dependsOn []string
+	// archives lists the names of the archives the job builds.
+	archives []string
+	run      func(ctx context.Context) []archiveResult
+}
+
+// scheduler runs jobs with bounded concurrency. A job starts once all the jobs it depends on
+// have finished, the ready jobs with the highest priority start first.
+type scheduler struct {
+	maxConcurrency int
+	jobs           []*job
+}
+
+func newScheduler(maxConcurrency int) *scheduler {
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+
+	return &scheduler{maxConcurrency: maxConcurrency}
+}
+
+func (s *scheduler) add(j *job) {
+	s.jobs = append(s.jobs, j)
+}
+
+type finishedJob struct {
+	job     *job
+	results []archiveResult
+}
+
+// run runs all the jobs and returns the results of all their archives.
+// Jobs which have not been started when the context is cancelled fail with the error of the context.
+func (s *scheduler) run(ctx context.Context) ([]archiveResult, error) {
+	err := s.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]*job, len(s.jobs))
+	copy(pending, s.jobs)
+	// the order of the jobs is kept between jobs of the same priority
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].priority > pending[j].priority
+	})
+
+	failed := make(map[string]bool, len(s.jobs))
+	finished := make(map[string]bool, len(s.jobs))
+	finishedCh := make(chan finishedJob)
+	var results []archiveResult
+	running := 0
+
+	for len(pending) > 0 || running > 0 {
+		var waiting []*job
+		for _, j := range pending {
+			ready, failedDependency := dependenciesOf(j, finished, failed)
+			switch {
+			case failedDependency != "":
+				results = append(results, skippedResults(j.archives, fmt.Sprintf("job %s it depends on has failed", failedDependency))...)
+				failed[j.name] = true
+				finished[j.name] = true
+			case !ready || running >= s.maxConcurrency:
+				waiting = append(waiting, j)
+			case ctx.Err() != nil:
+				results = append(results, failedResults(j.archives, ctx.Err())...)
+				failed[j.name] = true
+				finished[j.name] = true
+			default:
+				running++
+				go func(j *job) {
+					finishedCh <- finishedJob{job: j, results: j.run(ctx)}
+				}(j)
+			}
+		}
+
+		if len(waiting) == len(pending) && running == 0 {
+			// cannot happen after validate, it would be a dependency cycle
+			return nil, fmt.Errorf("jobs cannot be scheduled")
+		}
+		pending = waiting
+
+		if running == 0 {
+			continue
+		}
+
+		done := <-finishedCh
+		running--
+		finished[done.job.name] = true
+		for _, result := range done.results {
+			if result.status == archiveFailed {
+				failed[done.job.name] = true
+			}
+		}
+		results = append(results, done.results...)
+	}
+
+	return results, nil
+}
+
+// dependenciesOf tells whether all the dependencies of the job have finished and returns the first one which has failed.
+func dependenciesOf(j *job, finished, failed map[string]bool) (bool, string) {
+	ready := true
+	for _, dependency := range j.dependsOn {
+		if failed[dependency] {
+			return false, dependency
+		}
+		if !finished[dependency] {
+			ready = false
+		}
+	}
+
+	return ready, ""
+}
+
+// validate checks that all the dependencies exist and that there are no cycles.
+func (s *scheduler) validate() error {
+	byName := make(map[string]*job, len(s.jobs))
+	for _, j := range s.jobs {
+		if byName[j.name] != nil {
+			return fmt.Errorf("job %s is declared more than once", j.name)
+		}
+		byName[j.name] = j
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	states := make(map[string]int, len(s.jobs))
+	var visit func(j *job) error
+	visit = func(j *job) error {
+		switch states[j.name] {
+		case visiting:
+			return fmt.Errorf("job %s is part of a dependency cycle", j.name)
+		case visited:
+			return nil
+		}
+
+		states[j.name] = visiting
+		for _, dependency := range j.dependsOn {
+			d, ok := byName[dependency]
+			if !ok {
+				return fmt.Errorf("job %s depends on unknown job %s", j.name, dependency)
+			}
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		states[j.name] = visited
+		return nil
+	}
+
+	for _, j := range s.jobs {
+		if err := visit(j); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func skippedResults(archives []string, reason string) []archiveResult {
+	results := make([]archiveResult, 0, len(archives))
+	for _, name := range archives {
+		results = append(results, archiveResult{name: name, status: archiveSkipped, reason: reason})
+	}
+	return results
+}
+
+func failedResults(archives []string, err error) []archiveResult {
+	results := make([]archiveResult, 0, len(archives))
+	for _, name := range archives {
+		results = append(results, archiveResult{name: name, status: archiveFailed, err: err})
+	}
+	return results
+}
+
+// hasFailures tells whether any of the archives has failed, so the run has to exit with an error.
+func hasFailures(results []archiveResult) bool {
+	for _, result := range results {
+		if result.status == archiveFailed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// summarizeResults counts the archives by their status.
+func summarizeResults(results []archiveResult) runSummary {
+	var summary runSummary
+	for _, result := range results {
+		switch result.status {
+		case archiveSucceeded:
+			summary.Succeeded++
+		case archiveSkipped:
+			summary.Skipped++
+		case archiveFailed:
+			summary.Failed++
+		}
+	}
+
+	return summary
+}
+
+// logArchiveResults logs the result of every archive followed by the summary of the run.
+func logArchiveResults(results []archiveResult) {
+	for _, result := range results {
+		entry := log.WithFields(log.Fields{
+			"archive":             result.name,
+			"status":              result.status,
+			"duration":            result.duration.String(),
+			"noOfZippedFiles":     result.noOfZippedFiles,
+			"noOfReusedFiles":     result.noOfReusedFiles,
+			"noOfUnreadableFiles": result.noOfUnreadableFiles,
+		})
+
+		for _, sink := range result.sinks {
+			if sink.err != nil {
+				entry.WithError(sink.err).Errorf("Archive has not been published to sink %s", sink.name)
+			}
+		}
+
+		switch result.status {
+		case archiveFailed:
+			entry.WithError(result.err).Error("Archive has failed")
+		case archiveSkipped:
+			entry.Infof("Archive has been skipped: %s", result.reason)
+		default:
+			entry.Info("Archive has been uploaded")
+		}
+	}
+
+	summary := summarizeResults(results)
+	log.Infof("Zip creation process finished: %d archives succeeded, %d skipped, %d failed", summary.Succeeded, summary.Skipped, summary.Failed)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testJob returns a job which builds a single archive named after the job and records when it runs.
+func testJob(name string, priority int, err error, ran *[]string, mu *sync.Mutex, dependsOn ...string) *job {
+	return &job{
+		name:      name,
+		priority:  priority,
+		dependsOn: dependsOn,
+		archives:  []string{name + ".zip"},
+		run: func(ctx context.Context) []archiveResult {
+			mu.Lock()
+			*ran = append(*ran, name)
+			mu.Unlock()
+
+			if err != nil {
+				return failedResults([]string{name + ".zip"}, err)
+			}
+			return []archiveResult{{name: name + ".zip", status: archiveSucceeded}}
+		},
+	}
+}
+
+func resultStatuses(results []archiveResult) map[string]string {
+	statuses := make(map[string]string, len(results))
+	for _, result := range results {
+		statuses[result.name] = result.status
+	}
+	return statuses
+}
+
+func TestSchedulerPriorities(t *testing.T) {
+	var ran []string
+	var mu sync.Mutex
+	s := newScheduler(1)
+	s.add(testJob("low", 0, nil, &ran, &mu))
+	s.add(testJob("high", 10, nil, &ran, &mu))
+	s.add(testJob("dependent", 20, nil, &ran, &mu, "low"))
+	s.add(testJob("other-low", 0, nil, &ran, &mu))
+
+	results, err := s.run(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"high", "low", "dependent", "other-low"}, ran)
+	assert.Len(t, results, 4)
+	assert.False(t, hasFailures(results))
+}
+
+func TestSchedulerSkipsDependentsOfFailedJobs(t *testing.T) {
+	var ran []string
+	var mu sync.Mutex
+	s := newScheduler(2)
+	s.add(testJob("concepts", 0, errors.New("error"), &ran, &mu))
+	s.add(testJob("content", 0, nil, &ran, &mu, "concepts"))
+	s.add(testJob("images", 0, nil, &ran, &mu, "content"))
+	s.add(testJob("other", 0, nil, &ran, &mu))
+
+	results, err := s.run(context.Background())
+
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"concepts", "other"}, ran)
+	assert.Equal(t, map[string]string{
+		"concepts.zip": archiveFailed,
+		"content.zip":  archiveSkipped,
+		"images.zip":   archiveSkipped,
+		"other.zip":    archiveSucceeded,
+	}, resultStatuses(results))
+	assert.True(t, hasFailures(results))
+}
+
+func TestSchedulerBoundedConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	s := newScheduler(2)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		s.add(&job{
+			name:     name,
+			archives: []string{name + ".zip"},
+			run: func(ctx context.Context) []archiveResult {
+				mu.Lock()
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				mu.Unlock()
+
+				//give the other jobs the chance to start while this one is running
+				time.Sleep(10 * time.Millisecond)
+
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return []archiveResult{{name: name + ".zip", status: archiveSucceeded}}
+			},
+		})
+	}
+
+	results, err := s.run(context.Background())
+
+	assert.Nil(t, err)
+	assert.Len(t, results, 5)
+	assert.Equal(t, 2, maxRunning)
+}
+
+func TestSchedulerCancelled(t *testing.T) {
+	var ran []string
+	var mu sync.Mutex
+	s := newScheduler(1)
+	s.add(testJob("a", 0, nil, &ran, &mu))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results, err := s.run(ctx)
+
+	assert.Nil(t, err)
+	assert.Empty(t, ran)
+	assert.Equal(t, map[string]string{"a.zip": archiveFailed}, resultStatuses(results))
+}
+
+func TestSchedulerInvalidDependencies(t *testing.T) {
+	tests := map[string][]*job{
+		"UnknownDependency": {
+			{name: "a", dependsOn: []string{"b"}},
+		},
+		"Cycle": {
+			{name: "a", dependsOn: []string{"b"}},
+			{name: "b", dependsOn: []string{"c"}},
+			{name: "c", dependsOn: []string{"a"}},
+		},
+		"Duplicate": {
+			{name: "a"},
+			{name: "a"},
+		},
+	}
+
+	for name, jobs := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := newScheduler(1)
+			for _, j := range jobs {
+				s.add(j)
+			}
+
+			_, err := s.run(context.Background())
+			assert.Error(t, err)
+		})
+	}
+}
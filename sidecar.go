@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// archiveMetadata holds the stats of an uploaded archive,
+// so consumers can show them without downloading and opening the archive.
+type archiveMetadata struct {
+	ArchiveName       string    `json:"archiveName"`
+	FileCount         int       `json:"fileCount"`
+	UncompressedBytes int64     `json:"uncompressedBytes"`
+	CompressedBytes   int64     `json:"compressedBytes"`
+	SHA256            string    `json:"sha256"`
+	FirstPublishDate  string    `json:"firstPublishDate,omitempty"`
+	LastPublishDate   string    `json:"lastPublishDate,omitempty"`
+	BuildTime         time.Time `json:"buildTime"`
+	ToolVersion       string    `json:"toolVersion"`
+}
+
+func newArchiveMetadata(manifest *archiveManifest, compressedBytes int64, checksum string) *archiveMetadata {
+	metadata := &archiveMetadata{
+		ArchiveName:     manifest.ArchiveName,
+		FileCount:       len(manifest.Entries),
+		CompressedBytes: compressedBytes,
+		SHA256:          checksum,
+		BuildTime:       manifest.BuildTime,
+		ToolVersion:     version,
+	}
+
+	for _, entry := range manifest.Entries {
+		metadata.UncompressedBytes += entry.Size
+
+		if entry.PublishDate == "" {
+			continue
+		}
+		if metadata.FirstPublishDate == "" || entry.PublishDate < metadata.FirstPublishDate {
+			metadata.FirstPublishDate = entry.PublishDate
+		}
+		if entry.PublishDate > metadata.LastPublishDate {
+			metadata.LastPublishDate = entry.PublishDate
+		}
+	}
+
+	return metadata
+}
+
+func checksumFileName(zipName string) string {
+	return zipName + ".sha256"
+}
+
+func metadataFileName(zipName string) string {
+	return zipName + ".meta.json"
+}
+
+// uploadSidecarFiles uploads the files which describe a finished archive next to it:
+// its manifest, its SHA-256 checksum in the format used by sha256sum and its metadata.
+func uploadSidecarFiles(ctx context.Context, s3Config *s3Config, zipName string, manifest *archiveManifest, upload archiveUpload) error {
+	err := s3Config.uploadManifest(ctx, zipName, manifest)
+	if err != nil {
+		return err
+	}
+
+	checksum := upload.sha256()
+	err = s3Config.uploadSidecarFile(ctx, checksumFileName(zipName), checksumFileContent(checksum, zipName), "text/plain")
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(newArchiveMetadata(manifest, upload.archiveSize(), checksum))
+	if err != nil {
+		return fmt.Errorf("encoding metadata of archive %s: %w", zipName, err)
+	}
+
+	return s3Config.uploadSidecarFile(ctx, metadataFileName(zipName), data, "application/json")
+}
+
+// checksumFileContent is the content of the checksum file of an archive, in the format used by sha256sum.
+func checksumFileContent(checksum, zipName string) []byte {
+	return []byte(fmt.Sprintf("%s  %s\n", checksum, zipName))
+}
+
+// sidecarsMatch tells whether the sidecar files next to the archive describe it: its checksum file and its metadata
+// hold the checksum the archive has been published with and its manifest holds its source fingerprint.
+// Archives whose sidecar files could not be uploaded are published again by the next run.
+func (s3Config *s3Config) sidecarsMatch(ctx context.Context, zipName string, head *objectHead) bool {
+	checksum, ok := metadataValue(head.metadata, archiveSHA256Metadata)
+	if !ok {
+		return false
+	}
+
+	data, err := s3Config.getSidecarFile(ctx, checksumFileName(zipName))
+	if err != nil || string(data) != string(checksumFileContent(checksum, zipName)) {
+		return false
+	}
+
+	data, err = s3Config.getSidecarFile(ctx, metadataFileName(zipName))
+	if err != nil {
+		return false
+	}
+	var metadata archiveMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil || metadata.SHA256 != checksum {
+		return false
+	}
+
+	manifest, err := s3Config.getManifest(ctx, zipName)
+	if err != nil {
+		return false
+	}
+	fingerprint, _ := metadataValue(head.metadata, sourceFingerprintMetadata)
+	return manifest.SourceFingerprint == fingerprint
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewArchiveMetadata(t *testing.T) {
+	buildTime := time.Date(2024, time.May, 3, 10, 0, 0, 0, time.UTC)
+	manifest := &archiveManifest{
+		ArchiveName: "FT-archive-2016.zip",
+		BuildTime:   buildTime,
+		Entries: []manifestEntry{
+			{Key: "a", Size: 10, PublishDate: "2016-05-01"},
+			{Key: "b", Size: 20, PublishDate: "2016-01-31"},
+			{Key: "c", Size: 30},
+			{Key: "d", Size: 40, PublishDate: "2016-12-01"},
+		},
+	}
+
+	metadata := newArchiveMetadata(manifest, 42, "checksum")
+
+	assert.Equal(t, &archiveMetadata{
+		ArchiveName:       "FT-archive-2016.zip",
+		FileCount:         4,
+		UncompressedBytes: 100,
+		CompressedBytes:   42,
+		SHA256:            "checksum",
+		FirstPublishDate:  "2016-01-31",
+		LastPublishDate:   "2016-12-01",
+		BuildTime:         buildTime,
+		ToolVersion:       version,
+	}, metadata)
+}
+
+func TestNewArchiveMetadataWithoutPublishDates(t *testing.T) {
+	manifest := &archiveManifest{
+		ArchiveName: "FT-archive-concepts.zip",
+		Entries:     []manifestEntry{{Key: "a", Size: 10}},
+	}
+
+	metadata := newArchiveMetadata(manifest, 5, "checksum")
+
+	assert.Equal(t, 1, metadata.FileCount)
+	assert.Empty(t, metadata.FirstPublishDate)
+	assert.Empty(t, metadata.LastPublishDate)
+}
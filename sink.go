@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// destinationSinkName is the name of the sink of the destination bucket, or directory, of the run.
+const destinationSinkName = "destination"
+
+// mirror is a storage the archives are copied to besides the destination, e.g. a DR bucket in another region
+// or an NFS directory. The archives are written to the same folders as in the destination.
+type mirror struct {
+	name    string
+	storage storage
+}
+
+// mirrorSpec is a mirror as it is configured: either an s3 bucket, e.g. s3://dr-bucket?region=us-east-1,
+// or a local directory, e.g. file:///mnt/archives or just /mnt/archives.
+type mirrorSpec struct {
+	name   string
+	bucket string
+	// region is the region of the bucket, the region of the destination is used when it is empty.
+	region string
+	dir    string
+}
+
+func parseMirrorSpec(spec string) (mirrorSpec, error) {
+	if strings.HasPrefix(spec, "/") {
+		return mirrorSpec{name: "file://" + spec, dir: spec}, nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return mirrorSpec{}, fmt.Errorf("invalid mirror %s: %w", spec, err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return mirrorSpec{}, fmt.Errorf("invalid mirror %s: expected s3://<bucket>", spec)
+		}
+		return mirrorSpec{name: "s3://" + u.Host, bucket: u.Host, region: u.Query().Get("region")}, nil
+	case "file":
+		if u.Host != "" || u.Path == "" {
+			return mirrorSpec{}, fmt.Errorf("invalid mirror %s: expected file:///<dir>", spec)
+		}
+		return mirrorSpec{name: "file://" + u.Path, dir: u.Path}, nil
+	default:
+		return mirrorSpec{}, fmt.Errorf("invalid mirror %s: unknown scheme %q, expected s3 or file", spec, u.Scheme)
+	}
+}
+
+// sink is a storage an archive is published to, with the archives folder of the archive.
+type sink struct {
+	name   string
+	config *s3Config
+}
+
+// sinks returns the destination followed by the mirrors, all of them with the archives folder of the config.
+func (s3Config *s3Config) sinks() []sink {
+	sinks := []sink{{name: destinationSinkName, config: s3Config}}
+	for _, mirror := range s3Config.mirrors {
+		c := *s3Config
+		c.storage = mirror.storage
+		c.mirrors = nil
+		sinks = append(sinks, sink{name: mirror.name, config: &c})
+	}
+
+	return sinks
+}
+
+// newMirroredUpload starts to upload an archive to the destination and to all the mirrors.
+func (s3Config *s3Config) newMirroredUpload(ctx context.Context, s3FileName string, metadata map[string]*string) *mirroredUpload {
+	sinks := s3Config.sinks()
+	m := &mirroredUpload{
+		ctx:        ctx,
+		s3FileName: s3FileName,
+		metadata:   metadata,
+		uploads:    make([]*sinkUpload, 0, len(sinks)),
+	}
+	for _, sink := range sinks {
+		m.uploads = append(m.uploads, &sinkUpload{sink: sink, upload: sink.config.newArchiveUpload(ctx, s3FileName, metadata)})
+	}
+
+	return m
+}
+
+// outdatedSinks returns the names of the sinks which do not hold the archive of the provided source files with its sidecar files,
+// e.g. because the archive or its sidecar files could not be published to them by a previous run.
+func (s3Config *s3Config) outdatedSinks(ctx context.Context, s3FileName string, state sourceState) []string {
+	var outdated []string
+	for _, sink := range s3Config.sinks() {
+		head, err := sink.config.headArchive(ctx, s3FileName)
+		if err != nil || !state.matches(head.metadata) || !sink.config.sidecarsMatch(ctx, s3FileName, head) {
+			outdated = append(outdated, sink.name)
+		}
+	}
+
+	return outdated
+}
+
+// cleanStaging deletes the stale staging objects of the provided archives folders in the sinks which are s3 buckets.
+// A failed clean up does not stop the run, it is tried again by the next one.
+func (s3Config *s3Config) cleanStaging(ctx context.Context, archivesFolders []string, maxAge time.Duration) {
+	for _, sink := range s3Config.sinks() {
+		s3Storage, ok := sink.config.storage.(*s3Storage)
+		if !ok {
+			continue
+		}
+
+		for _, archivesFolder := range archivesFolders {
+			deleted, err := s3Storage.cleanStaging(ctx, archivesFolder, maxAge)
+			if err != nil {
+				log.WithError(err).Warnf("Cannot clean up staging objects of folder %s of sink %s", archivesFolder, sink.name)
+			}
+			if deleted > 0 {
+				log.Infof("Deleted %d stale staging objects of folder %s of sink %s", deleted, archivesFolder, sink.name)
+			}
+		}
+	}
+}
+
+// archivesFolders returns the folders the archives are uploaded to, each of them once.
+func (s3Config *s3Config) archivesFolders(zipConfigs []*zipConfig) []string {
+	var folders []string
+	seen := make(map[string]bool)
+	for _, zipConfig := range zipConfigs {
+		folder := s3Config.withArchivesFolder(zipConfig.archivesFolder).archivesFolder
+		if !seen[folder] {
+			seen[folder] = true
+			folders = append(folders, folder)
+		}
+	}
+
+	return folders
+}
+
+// sinkResult is the outcome of publishing an archive to a single sink.
+type sinkResult struct {
+	name string
+	err  error
+}
+
+// sinkUpload is the upload of an archive to a single sink. Once it has failed, nothing is written to it anymore.
+type sinkUpload struct {
+	sink   sink
+	upload archiveUpload
+	err    error
+}
+
+func (u *sinkUpload) fail(err error) {
+	log.WithError(err).Errorf("Publishing archive %s to sink %s has failed", u.upload.archiveKey(), u.sink.name)
+	u.err = err
+	abortUpload(u.upload)
+}
+
+// mirroredUpload streams an archive to all its sinks at once. A sink which fails is dropped,
+// the archive is still published to the others. It only fails once every sink has failed.
+// The calls to a sink are retried with the retry policy of its storage, so a slow sink does not retry the others.
+type mirroredUpload struct {
+	ctx        context.Context
+	s3FileName string
+	metadata   map[string]*string
+	uploads    []*sinkUpload
+}
+
+// active returns the uploads which have not failed yet.
+func (m *mirroredUpload) active() []*sinkUpload {
+	active := make([]*sinkUpload, 0, len(m.uploads))
+	for _, u := range m.uploads {
+		if u.err == nil {
+			active = append(active, u)
+		}
+	}
+	return active
+}
+
+// errAllSinksFailed returns the error of the first sink once every sink has failed.
+func (m *mirroredUpload) errAllSinksFailed() error {
+	if len(m.active()) > 0 {
+		return nil
+	}
+
+	return fmt.Errorf("publishing to every sink has failed: %w", m.uploads[0].err)
+}
+
+func (m *mirroredUpload) Write(p []byte) (int, error) {
+	for _, u := range m.active() {
+		if _, err := u.upload.Write(p); err != nil {
+			u.fail(err)
+		}
+	}
+	if err := m.errAllSinksFailed(); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// stage finishes the uploads of all the sinks without publishing the archive. It returns an error only if every sink has failed.
+func (m *mirroredUpload) stage() error {
+	for _, u := range m.active() {
+		if err := u.upload.stage(); err != nil {
+			u.fail(err)
+		}
+	}
+
+	return m.errAllSinksFailed()
+}
+
+// publish stages the archive in every sink, uploads its sidecar files next to it and only then publishes the archive,
+// so an archive is never published next to the sidecar files of another version of it.
+// A sink whose archive or sidecar files cannot be uploaded is dropped, the archive is not published to it.
+// It returns an error only if every sink has failed.
+func (m *mirroredUpload) publish(manifest *archiveManifest) error {
+	err := m.stage()
+	if err != nil {
+		return err
+	}
+
+	for _, u := range m.active() {
+		err = uploadSidecarFiles(m.ctx, u.sink.config, m.s3FileName, manifest, u.upload)
+		if err != nil {
+			u.fail(fmt.Errorf("cannot upload sidecar files: %w", err))
+		}
+	}
+
+	return m.Close()
+}
+
+// Close completes the uploads of all the sinks. It returns an error only if every sink has failed,
+// the errors of the single sinks are returned by results.
+func (m *mirroredUpload) Close() error {
+	for _, u := range m.active() {
+		if err := u.upload.Close(); err != nil {
+			u.fail(err)
+		}
+	}
+
+	return m.errAllSinksFailed()
+}
+
+func (m *mirroredUpload) Abort() error {
+	var errs []error
+	for _, u := range m.active() {
+		if err := u.upload.Abort(); err != nil {
+			errs = append(errs, fmt.Errorf("sink %s: %w", u.sink.name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkpoint returns the checkpoint of the destination with the checkpoints of the mirrors in it.
+// Archives with a failed sink cannot be checkpointed, as that sink could not be resumed.
+func (m *mirroredUpload) checkpoint() (uploadCheckpoint, error) {
+	var checkpoint uploadCheckpoint
+	for i, u := range m.uploads {
+		if u.err != nil {
+			return uploadCheckpoint{}, fmt.Errorf("publishing to sink %s has failed: %w", u.sink.name, u.err)
+		}
+
+		c, err := u.upload.checkpoint()
+		if err != nil {
+			return uploadCheckpoint{}, fmt.Errorf("sink %s: %w", u.sink.name, err)
+		}
+		if i == 0 {
+			checkpoint = c
+			continue
+		}
+		if checkpoint.Mirrors == nil {
+			checkpoint.Mirrors = make(map[string]uploadCheckpoint, len(m.uploads)-1)
+		}
+		checkpoint.Mirrors[u.sink.name] = c
+	}
+
+	return checkpoint, nil
+}
+
+// resume continues the uploads of all the sinks, it fails if any of them cannot be continued,
+// e.g. because the mirror has been added since the checkpoint was saved.
+// The uploads which have been resumed before the failure are started again, so the archive can be built from scratch.
+func (m *mirroredUpload) resume(checkpoint uploadCheckpoint) error {
+	for i, u := range m.uploads {
+		err := m.resumeSink(i, checkpoint)
+		if err == nil {
+			continue
+		}
+
+		for _, resumed := range m.uploads[:i] {
+			resumed.upload = resumed.sink.config.newArchiveUpload(m.ctx, m.s3FileName, m.metadata)
+		}
+		return fmt.Errorf("sink %s: %w", u.sink.name, err)
+	}
+
+	return nil
+}
+
+func (m *mirroredUpload) resumeSink(i int, checkpoint uploadCheckpoint) error {
+	if i == 0 {
+		checkpoint.Mirrors = nil
+		return m.uploads[0].upload.resume(checkpoint)
+	}
+
+	c, ok := checkpoint.Mirrors[m.uploads[i].sink.name]
+	if !ok {
+		return errors.New("checkpoint has no upload to the sink")
+	}
+	return m.uploads[i].upload.resume(c)
+}
+
+func (m *mirroredUpload) setMetadata(metadata map[string]*string) {
+	m.metadata = metadata
+	for _, u := range m.uploads {
+		u.upload.setMetadata(metadata)
+	}
+}
+
+// archiveKey, archiveSize and sha256 describe the upload to the destination, the same archive is written to every sink.
+func (m *mirroredUpload) archiveKey() string {
+	return m.uploads[0].upload.archiveKey()
+}
+
+func (m *mirroredUpload) archiveSize() int64 {
+	return m.uploads[0].upload.archiveSize()
+}
+
+func (m *mirroredUpload) sha256() string {
+	return m.uploads[0].upload.sha256()
+}
+
+func (m *mirroredUpload) results() []sinkResult {
+	results := make([]sinkResult, 0, len(m.uploads))
+	for _, u := range m.uploads {
+		results = append(results, sinkResult{name: u.sink.name, err: u.err})
+	}
+	return results
+}
+
+// failedSinksError returns an error which names the sinks which have failed, nil if all of them have succeeded.
+func failedSinksError(results []sinkResult) error {
+	var errs []error
+	for _, result := range results {
+		if result.err != nil {
+			errs = append(errs, fmt.Errorf("sink %s: %w", result.name, result.err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMirrorSpec(t *testing.T) {
+	tests := map[string]struct {
+		spec    string
+		want    mirrorSpec
+		wantErr bool
+	}{
+		"Bucket": {
+			spec: "s3://dr-bucket",
+			want: mirrorSpec{name: "s3://dr-bucket", bucket: "dr-bucket"},
+		},
+		"BucketWithRegion": {
+			spec: "s3://dr-bucket?region=us-east-1",
+			want: mirrorSpec{name: "s3://dr-bucket", bucket: "dr-bucket", region: "us-east-1"},
+		},
+		"Dir": {
+			spec: "file:///mnt/archives",
+			want: mirrorSpec{name: "file:///mnt/archives", dir: "/mnt/archives"},
+		},
+		"Path": {
+			spec: "/mnt/archives",
+			want: mirrorSpec{name: "file:///mnt/archives", dir: "/mnt/archives"},
+		},
+		"BucketWithFolder": {
+			spec:    "s3://dr-bucket/archives",
+			wantErr: true,
+		},
+		"RelativeDir": {
+			spec:    "file://mnt/archives",
+			wantErr: true,
+		},
+		"UnknownScheme": {
+			spec:    "gs://dr-bucket",
+			wantErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseMirrorSpec(test.spec)
+			assert.Equal(t, test.wantErr, err != nil)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestZipAndUploadFilesToMirrors(t *testing.T) {
+	files := []*fileInfo{
+		{key: fmt.Sprintf("test-folder/%s_2016-01-01.json", "0b2d3f6a-5b4e-11e7-9bc8-8055f264aa8b"), eTag: "etag-0"},
+		{key: fmt.Sprintf("test-folder/%s_2016-02-01.json", "1f0a0b6e-5b4e-11e7-9bc8-8055f264aa8b"), eTag: "etag-1"},
+	}
+	zipConfigs := []*zipConfig{newZipConfig("FT-archive-2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016)}
+	mockClient := &mockS3Client{}
+	drClient := &mockS3Client{failingKeys: map[string]bool{"archives/FT-archive-2016.zip": true}}
+	drBucket := newS3Storage(drClient, "dr-bucket")
+	drBucket.retry = newTestRetryPolicy()
+	dir := t.TempDir()
+	s3Config := newS3Config(mockClient, "test-bucket", "archives")
+	s3Config.mirrors = []mirror{{name: "s3://dr-bucket", storage: drBucket}, {name: "file://" + dir, storage: newDirStorage(dir)}}
+
+	//the failing mirror fails the archive, but the other sinks still get it
+	results := zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, nil, nil)
+	assert.Equal(t, archiveFailed, results[0].status)
+	assert.Len(t, results[0].sinks, 3)
+	assert.Equal(t, destinationSinkName, results[0].sinks[0].name)
+	assert.Nil(t, results[0].sinks[0].err)
+	assert.Error(t, results[0].sinks[1].err)
+	assert.Nil(t, results[0].sinks[2].err)
+	assert.Equal(t, int64(2), mockClient.getObjectCalls, "files should be downloaded once for all the sinks")
+
+	destinationData, _, ok := mockClient.storedObject("archives/FT-archive-2016.zip")
+	assert.True(t, ok)
+	dirData, err := os.ReadFile(filepath.Join(dir, "archives", "FT-archive-2016.zip"))
+	assert.Nil(t, err)
+	assert.Equal(t, destinationData, dirData)
+	_, _, ok = mockClient.storedObject("archives/FT-archive-2016.zip.sha256")
+	assert.True(t, ok)
+	assert.FileExists(t, filepath.Join(dir, "archives", "FT-archive-2016.zip.sha256"))
+	//the sidecar files are uploaded before the archive is promoted, the failing mirror keeps no archive next to them
+	_, _, ok = drClient.storedObject("archives/FT-archive-2016.zip.sha256")
+	assert.True(t, ok)
+	_, _, ok = drClient.storedObject("archives/FT-archive-2016.zip")
+	assert.False(t, ok)
+
+	//the archive is published again while any of the mirrors is outdated
+	mockClient.headMetadata = mockClient.uploadMetadata
+	drClient.failingKeys = nil
+	results = zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, nil, nil)
+	assert.Equal(t, archiveSucceeded, results[0].status)
+	assert.Nil(t, failedSinksError(results[0].sinks))
+	_, _, ok = drClient.storedObject("archives/FT-archive-2016.zip")
+	assert.True(t, ok)
+}
+
+func TestMirroredUploadResumeFailure(t *testing.T) {
+	dir := t.TempDir()
+	s3Config := newStorageConfig(newDirStorage(filepath.Join(dir, "destination")), "archives")
+	s3Config.mirrors = []mirror{{name: "mirror", storage: newDirStorage(filepath.Join(dir, "mirror"))}}
+
+	upload := s3Config.newMirroredUpload(context.Background(), "test.zip", nil)
+	_, err := upload.Write([]byte("0123"))
+	assert.Nil(t, err)
+	checkpoint, err := upload.checkpoint()
+	assert.Nil(t, err)
+	assert.Contains(t, checkpoint.Mirrors, "mirror")
+
+	//a checkpoint without the mirror cannot be resumed, the archive is built from scratch instead
+	delete(checkpoint.Mirrors, "mirror")
+	resumed := s3Config.newMirroredUpload(context.Background(), "test.zip", nil)
+	assert.Error(t, resumed.resume(checkpoint))
+	_, err = resumed.Write([]byte("abcd"))
+	assert.Nil(t, err)
+	assert.Nil(t, resumed.Close())
+
+	for _, sink := range []string{"destination", "mirror"} {
+		data, err := os.ReadFile(filepath.Join(dir, sink, "archives", "test.zip"))
+		assert.Nil(t, err)
+		assert.Equal(t, "abcd", string(data))
+	}
+}
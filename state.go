@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const (
+	sourceCountMetadata        = "source-count"
+	sourceLastModifiedMetadata = "source-last-modified"
+	sourceFingerprintMetadata  = "source-fingerprint"
+	// archiveSHA256Metadata is the hex SHA-256 checksum of the archive, which its sidecar files have to hold as well.
+	archiveSHA256Metadata = "archive-sha256"
+)
+
+// sourceState describes the source files an archive has been built from.
+// It is stored as metadata of the uploaded archive, so the next run can tell whether
+// the archive has to be rebuilt.
+type sourceState struct {
+	count        int
+	lastModified time.Time
+	fingerprint  string
+}
+
+func newSourceState(files []*fileInfo) sourceState {
+	state := sourceState{
+		count: len(files),
+	}
+
+	hash := sha256.New()
+	for _, file := range files {
+		if file.lastModified.After(state.lastModified) {
+			state.lastModified = file.lastModified
+		}
+		fmt.Fprintf(hash, "%s\t%s\n", file.key, file.eTag)
+	}
+	state.fingerprint = hex.EncodeToString(hash.Sum(nil))
+
+	return state
+}
+
+func (s sourceState) metadata() map[string]*string {
+	return map[string]*string{
+		sourceCountMetadata:        aws.String(strconv.Itoa(s.count)),
+		sourceLastModifiedMetadata: aws.String(s.lastModified.UTC().Format(time.RFC3339)),
+		sourceFingerprintMetadata:  aws.String(s.fingerprint),
+	}
+}
+
+// matches checks whether the metadata of an existing archive describes the same source files.
+func (s sourceState) matches(metadata map[string]*string) bool {
+	for name, value := range s.metadata() {
+		existing, ok := metadataValue(metadata, name)
+		if !ok || existing != *value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// metadataValue looks up user metadata case-insensitively,
+// as the aws sdk returns the names in canonical header form.
+func metadataValue(metadata map[string]*string, name string) (string, bool) {
+	for k, v := range metadata {
+		if strings.EqualFold(k, name) && v != nil {
+			return *v, true
+		}
+	}
+
+	return "", false
+}
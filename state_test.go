@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSourceState(t *testing.T) {
+	lastModified := time.Date(2020, time.May, 3, 10, 0, 0, 0, time.UTC)
+	files := []*fileInfo{
+		{key: "folder/a.json", eTag: "etag-a", lastModified: lastModified.Add(-time.Hour)},
+		{key: "folder/b.json", eTag: "etag-b", lastModified: lastModified},
+	}
+
+	state := newSourceState(files)
+
+	assert.Equal(t, 2, state.count)
+	assert.Equal(t, lastModified, state.lastModified)
+	assert.Len(t, state.fingerprint, 64)
+
+	files[1] = &fileInfo{key: "folder/b.json", eTag: "etag-b-updated", lastModified: lastModified}
+	assert.NotEqual(t, state.fingerprint, newSourceState(files).fingerprint)
+}
+
+func TestSourceStateMatches(t *testing.T) {
+	state := newSourceState([]*fileInfo{{key: "folder/a.json", eTag: "etag-a"}})
+	metadata := state.metadata()
+
+	tests := map[string]struct {
+		metadata map[string]*string
+		want     bool
+	}{
+		"SameState": {
+			metadata: metadata,
+			want:     true,
+		},
+		"CanonicalHeaderNames": {
+			metadata: map[string]*string{
+				"Source-Count":         metadata[sourceCountMetadata],
+				"Source-Last-Modified": metadata[sourceLastModifiedMetadata],
+				"Source-Fingerprint":   metadata[sourceFingerprintMetadata],
+			},
+			want: true,
+		},
+		"DifferentFingerprint": {
+			metadata: map[string]*string{
+				sourceCountMetadata:        metadata[sourceCountMetadata],
+				sourceLastModifiedMetadata: metadata[sourceLastModifiedMetadata],
+				sourceFingerprintMetadata:  aws.String("other"),
+			},
+		},
+		"MissingMetadata": {
+			metadata: map[string]*string{},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.want, state.matches(test.metadata))
+		})
+	}
+}
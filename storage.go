@@ -2,148 +2,548 @@ package main
 
 import (
 	"bytes"
-	"crypto/md5"
-	"encoding/base64"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"io/fs"
+	"net/url"
+	"path"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	s3 "github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
 
+// storage is where the source files are read from and the archives are written to:
+// an s3 bucket or a local directory, e.g. for local development and one-off exports.
+// Keys are slash separated, like s3 keys.
+type storage interface {
+	// listFiles lists the files whose key starts with the prefix, ordered by key.
+	listFiles(ctx context.Context, prefix string) ([]*fileInfo, error)
+	// readObject returns the whole content of a file.
+	readObject(ctx context.Context, key string) ([]byte, error)
+	// openObject gives random access to a file of the provided size, e.g. to an archive uploaded by a previous run.
+	openObject(ctx context.Context, key string, size int64) io.ReaderAt
+	headObject(ctx context.Context, key string) (*objectHead, error)
+	putObject(ctx context.Context, key string, data []byte, contentType string) error
+	deleteObject(ctx context.Context, key string) error
+	// putArchive streams an archive to the key while it is being written.
+	// The archive only shows up under its key once the upload is closed.
+	putArchive(ctx context.Context, key string, metadata map[string]*string) archiveUpload
+}
+
+// s3Config is where a run reads its source files from and where it writes its archives to:
+// the archives folder of a storage, which is an s3 bucket unless the app runs against a local directory.
 type s3Config struct {
-	svc            s3iface.S3API
-	bucketName     string
-	archivesFolder string
+	storage storage
+	// source is where the source files are read from. It can be another bucket than storage,
+	// accessed with other credentials, e.g. read-only ones, as nothing is ever written to it.
+	source storage
+	// mirrors are the storages the archives are copied to besides storage.
+	mirrors         []mirror
+	archivesFolder  string
+	downloadWorkers int
+	// maxOpenArchives is the number of archives of a folder which are written at the same time, all of them when it is 0.
+	maxOpenArchives int
+	// prefetched holds the source files which have been downloaded before they are written to the archives.
+	prefetched *prefetchedFiles
 }
 
 func newS3Config(s3Client s3iface.S3API, bucketName, archivesFolder string) *s3Config {
+	return newStorageConfig(newS3Storage(s3Client, bucketName), archivesFolder)
+}
+
+func newStorageConfig(storage storage, archivesFolder string) *s3Config {
 	return &s3Config{
-		svc:            s3Client,
-		bucketName:     bucketName,
-		archivesFolder: archivesFolder,
+		storage:         storage,
+		source:          storage,
+		archivesFolder:  archivesFolder,
+		downloadWorkers: defaultDownloadWorkers,
+		maxOpenArchives: defaultMaxOpenArchives,
+		prefetched:      newPrefetchedFiles(maxPrefetchedBytes),
 	}
 }
 
-func (s3Config *s3Config) uploadFile(localFileName string, s3FileName string) error {
-	log.Infof("Uploading file %s to s3...", localFileName)
+// withArchivesFolder returns a copy of the config which uploads the archives to another folder.
+func (s3Config *s3Config) withArchivesFolder(archivesFolder string) *s3Config {
+	if archivesFolder == "" || archivesFolder == s3Config.archivesFolder {
+		return s3Config
+	}
+
+	c := *s3Config
+	c.archivesFolder = archivesFolder
+	return &c
+}
+
+// fileInfo holds the details of a listed file.
+type fileInfo struct {
+	key          string
+	eTag         string
+	size         int64
+	lastModified time.Time
+}
+
+func (s3Config *s3Config) listFiles(ctx context.Context, folderName string) ([]*fileInfo, error) {
+	log.Infof("Starting fileKeys retrieval from s3 folder: %s..", folderName)
+
+	result, err := s3Config.source.listFiles(ctx, folderName)
+	if err != nil {
+		return nil, fmt.Errorf("listing objects: %w", err)
+	}
+
+	log.Infof("Finished fileKeys retrieval from s3 folder name %s. There are %d files", folderName, len(result))
+	return result, nil
+}
+
+// objectHead holds the details of an archive which has been uploaded by a previous run.
+type objectHead struct {
+	size     int64
+	metadata map[string]*string
+	// checksumSHA256 is the base64 encoded SHA-256 checksum s3 has stored for the object, empty if it has none.
+	// The checksum of an object uploaded in parts is the checksum of the checksums of its parts, followed by -<number of parts>.
+	checksumSHA256 string
+}
+
+func (s3Config *s3Config) headArchive(ctx context.Context, s3FileName string) (*objectHead, error) {
+	head, err := s3Config.storage.headObject(ctx, s3Config.archiveKey(s3FileName))
+	if err != nil {
+		return nil, fmt.Errorf("getting metadata of archive %s: %w", s3FileName, err)
+	}
+
+	return head, nil
+}
+
+// headObject returns the details of a source file.
+func (s3Config *s3Config) headObject(ctx context.Context, key string) (*objectHead, error) {
+	return s3Config.source.headObject(ctx, key)
+}
+
+// openArchive returns a reader for an archive which has been uploaded by a previous run.
+// The archive is read in blocks, so it never has to be downloaded as a whole.
+func (s3Config *s3Config) openArchive(ctx context.Context, s3FileName string, size int64) io.ReaderAt {
+	return s3Config.storage.openObject(ctx, s3Config.archiveKey(s3FileName), size)
+}
+
+// newArchiveUpload starts to upload an archive with the provided metadata to the archives folder.
+func (s3Config *s3Config) newArchiveUpload(ctx context.Context, s3FileName string, metadata map[string]*string) archiveUpload {
+	return s3Config.storage.putArchive(ctx, s3Config.archiveKey(s3FileName), metadata)
+}
+
+func (s3Config *s3Config) archiveKey(s3FileName string) string {
+	return fmt.Sprintf("%s/%s", s3Config.archivesFolder, s3FileName)
+}
+
+// getManifest returns the manifest of an archive which has been uploaded by a previous run.
+func (s3Config *s3Config) getManifest(ctx context.Context, s3FileName string) (*archiveManifest, error) {
+	data, err := s3Config.getSidecarFile(ctx, manifestFileName(s3FileName))
+	if err != nil {
+		return nil, fmt.Errorf("downloading manifest of archive %s: %w", s3FileName, err)
+	}
 
-	f, err := os.ReadFile(localFileName)
+	manifest := &archiveManifest{}
+	err = json.Unmarshal(data, manifest)
 	if err != nil {
-		return fmt.Errorf("reading file: %w", err)
+		return nil, fmt.Errorf("decoding manifest of archive %s: %w", s3FileName, err)
 	}
 
-	fileHash := md5.Sum([]byte(f))
-	// EncodeToString want slice, not array
-	base64EncodedMD5Hash := base64.StdEncoding.EncodeToString(fileHash[:])
+	return manifest, nil
+}
 
-	input := &s3.PutObjectInput{
-		Bucket: aws.String(s3Config.bucketName),
-		Key:    aws.String(fmt.Sprintf("%s/%s", s3Config.archivesFolder, s3FileName)),
-		Body:   bytes.NewReader(f),
+// uploadManifest uploads the manifest of an archive next to it,
+// so the next run can tell what the archive holds without opening it.
+func (s3Config *s3Config) uploadManifest(ctx context.Context, s3FileName string, manifest *archiveManifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("encoding manifest of archive %s: %w", s3FileName, err)
+	}
+
+	return s3Config.uploadSidecarFile(ctx, manifestFileName(s3FileName), data, "application/json")
+}
 
-		// Optional: integrity check to verify that the data is the same data
-		// that was originally sent.
-		ContentMD5: aws.String(base64EncodedMD5Hash),
+// getSidecarFile downloads a small file from the archives folder.
+func (s3Config *s3Config) getSidecarFile(ctx context.Context, s3FileName string) ([]byte, error) {
+	return s3Config.storage.readObject(ctx, s3Config.archiveKey(s3FileName))
+}
+
+func (s3Config *s3Config) deleteSidecarFile(ctx context.Context, s3FileName string) error {
+	err := s3Config.storage.deleteObject(ctx, s3Config.archiveKey(s3FileName))
+	if err != nil {
+		return fmt.Errorf("could not delete file with name %s from s3: %w", s3FileName, err)
 	}
 
-	_, err = s3Config.svc.PutObject(input)
+	return nil
+}
+
+// uploadSidecarFile uploads a small file which describes an archive to the archives folder.
+func (s3Config *s3Config) uploadSidecarFile(ctx context.Context, s3FileName string, data []byte, contentType string) error {
+	err := s3Config.storage.putObject(ctx, s3Config.archiveKey(s3FileName), data, contentType)
 	if err != nil {
-		return fmt.Errorf("could not upload file with name %s to s3:%w", s3FileName, err)
+		return fmt.Errorf("could not upload file with name %s to s3: %w", s3FileName, err)
 	}
 
-	log.Infof("Finished uploading file %s to s3", localFileName)
 	return nil
 }
 
-// TODO: aws sdk supports retrying mechanism
-func (s3Config *s3Config) downloadFile(fileName string, noOfRetries int) (s3Object, error) {
-	input := &s3.GetObjectInput{
-		Bucket: aws.String(s3Config.bucketName),
-		Key:    aws.String(fileName),
+// isNotFound tells whether the error has been returned for a file which does not exist.
+func isNotFound(err error) bool {
+	var aerr awserr.RequestFailure
+	if errors.As(err, &aerr) && aerr.StatusCode() == 404 {
+		return true
 	}
-	output, err := s3Config.svc.GetObject(input)
+
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+const (
+	// stagingFolderName is the folder next to the archives which they are uploaded to before they are copied to their key.
+	stagingFolderName = ".staging"
+	// defaultStagingMaxAge is the age after which a staging object is considered to be left behind by a crashed run.
+	defaultStagingMaxAge = 24 * time.Hour
+	// S3 copies objects of up to 5GiB with a single CopyObject call, larger ones have to be copied in parts.
+	defaultMaxCopySize  = 5 * 1024 * 1024 * 1024
+	defaultCopyPartSize = 512 * 1024 * 1024
+)
+
+// s3Storage keeps the files in an s3 bucket. All its calls are retried with its retry policy.
+type s3Storage struct {
+	svc        s3iface.S3API
+	bucketName string
+	// partSize is the size of the parts of the multipart uploads and of the blocks the archives are read in.
+	partSize int
+	// maxCopySize is the size above which objects are copied in parts of copyPartSize.
+	maxCopySize  int64
+	copyPartSize int64
+	retry        *retryPolicy
+}
+
+func newS3Storage(s3Client s3iface.S3API, bucketName string) *s3Storage {
+	return &s3Storage{
+		svc:          s3Client,
+		bucketName:   bucketName,
+		partSize:     defaultUploadPartSize,
+		maxCopySize:  defaultMaxCopySize,
+		copyPartSize: defaultCopyPartSize,
+		retry:        newRetryPolicy(defaultRetryMaxElapsedTime),
+	}
+}
+
+// stagingKey returns the key the archive is uploaded to, e.g. archives/.staging/FT-archive-2016.zip for archives/FT-archive-2016.zip.
+func stagingKey(key string) string {
+	return path.Join(path.Dir(key), stagingFolderName, path.Base(key))
+}
+
+// stagingPrefix returns the prefix of the staging objects of the archives of the folder.
+func stagingPrefix(archivesFolder string) string {
+	return path.Join(archivesFolder, stagingFolderName) + "/"
+}
+
+// listFiles lists the files page by page. A failed listing is started again from its first page.
+func (s *s3Storage) listFiles(ctx context.Context, prefix string) ([]*fileInfo, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(prefix),
+	}
+	var result []*fileInfo
+	err := s.retry.do(ctx, "list "+prefix, func() error {
+		result = make([]*fileInfo, 0, 32)
+		return s.svc.ListObjectsV2PagesWithContext(ctx, input, func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range output.Contents {
+				result = append(result, &fileInfo{
+					key:          aws.StringValue(obj.Key),
+					eTag:         aws.StringValue(obj.ETag),
+					size:         aws.Int64Value(obj.Size),
+					lastModified: aws.TimeValue(obj.LastModified),
+				})
+			}
+			return true
+		})
+	})
 	if err != nil {
-		log.WithError(err).Errorf("Cannot download file with name %s from s3. Sleeping for 5 seconds and retrying..", fileName)
-		time.Sleep(5 * time.Second)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// readObject downloads the object. A failed read of the body is retried as well.
+func (s *s3Storage) readObject(ctx context.Context, key string) ([]byte, error) {
+	return s.readRange(ctx, key, nil)
+}
 
-		// check here so that we can wrap the original error returned from AWS
-		if noOfRetries < 1 {
-			return nil, fmt.Errorf("downloading file: %w", err)
+// readRange downloads the object, or only a range of its bytes if byteRange is set.
+func (s *s3Storage) readRange(ctx context.Context, key string, byteRange *string) ([]byte, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+		Range:  byteRange,
+	}
+	var data []byte
+	err := s.retry.do(ctx, "get "+key, func() error {
+		output, err := s.svc.GetObjectWithContext(ctx, input)
+		if err != nil {
+			return err
 		}
-		return s3Config.downloadFile(fileName, noOfRetries-1)
+		defer output.Body.Close()
+
+		data, err = io.ReadAll(output.Body)
+		return err
+	})
+
+	return data, err
+}
+
+// openObject reads the object with ranged requests.
+func (s *s3Storage) openObject(ctx context.Context, key string, size int64) io.ReaderAt {
+	return &s3ReaderAt{
+		ctx:       ctx,
+		storage:   s,
+		key:       key,
+		size:      size,
+		blockSize: int64(s.partSize),
+	}
+}
+
+func (s *s3Storage) headObject(ctx context.Context, key string) (*objectHead, error) {
+	input := &s3.HeadObjectInput{
+		Bucket:       aws.String(s.bucketName),
+		Key:          aws.String(key),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	}
+	var output *s3.HeadObjectOutput
+	err := s.retry.do(ctx, "head "+key, func() error {
+		var err error
+		output, err = s.svc.HeadObjectWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return &s3obj{
-		key:  fileName,
-		data: output.Body,
+	return &objectHead{
+		size:           aws.Int64Value(output.ContentLength),
+		metadata:       output.Metadata,
+		checksumSHA256: aws.StringValue(output.ChecksumSHA256),
 	}, nil
 }
 
-func (s3Config *s3Config) getFileKeys(folderName string) ([]string, error) {
-	log.Infof("Starting fileKeys retrieval from s3 folder: %s..", folderName)
+func (s *s3Storage) putObject(ctx context.Context, key string, data []byte, contentType string) error {
+	return s.retry.do(ctx, "put "+key, func() error {
+		//the body is read by every attempt, so every attempt gets its own reader
+		input := &s3.PutObjectInput{
+			Bucket:      aws.String(s.bucketName),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(data),
+			ContentType: aws.String(contentType),
+			ContentMD5:  aws.String(base64MD5(data)),
+		}
+		_, err := s.svc.PutObjectWithContext(ctx, input)
+		return err
+	})
+}
+
+func (s *s3Storage) deleteObject(ctx context.Context, key string) error {
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	}
+	return s.retry.do(ctx, "delete "+key, func() error {
+		_, err := s.svc.DeleteObjectWithContext(ctx, input)
+		return err
+	})
+}
+
+// abortMultipartUpload discards the parts of a multipart upload.
+func (s *s3Storage) abortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	input := &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}
+	return s.retry.do(ctx, "abort upload of "+key, func() error {
+		_, err := s.svc.AbortMultipartUploadWithContext(ctx, input)
+		return err
+	})
+}
+
+func (s *s3Storage) putArchive(ctx context.Context, key string, metadata map[string]*string) archiveUpload {
+	return newS3Upload(ctx, s, key, metadata)
+}
+
+func (s *s3Storage) copySource(key string) *string {
+	return aws.String(url.PathEscape(s.bucketName) + "/" + (&url.URL{Path: key}).EscapedPath())
+}
+
+// copyObject copies an object of up to maxCopySize within the bucket and gives the copy the provided metadata.
+func (s *s3Storage) copyObject(ctx context.Context, sourceKey, key string, metadata map[string]*string) error {
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucketName),
+		Key:               aws.String(key),
+		CopySource:        s.copySource(sourceKey),
+		Metadata:          metadata,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	}
+	return s.retry.do(ctx, "copy "+sourceKey+" to "+key, func() error {
+		_, err := s.svc.CopyObjectWithContext(ctx, input)
+		return err
+	})
+}
+
+// copyObjectInParts copies a large object within the bucket with a multipart upload whose parts are copied by s3.
+// The metadata is not copied by UploadPartCopy, so it has to be provided.
+func (s *s3Storage) copyObjectInParts(ctx context.Context, sourceKey, key string, size int64, metadata map[string]*string) error {
+	createInput := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(s.bucketName),
+		Key:      aws.String(key),
+		Metadata: metadata,
+	}
+	var upload *s3.CreateMultipartUploadOutput
+	err := s.retry.do(ctx, "start copy of "+sourceKey+" to "+key, func() error {
+		var err error
+		upload, err = s.svc.CreateMultipartUploadWithContext(ctx, createInput)
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
-	listObjects := func(startAfter string) ([]string, bool, error) {
-		input := &s3.ListObjectsV2Input{
-			Bucket:     aws.String(s3Config.bucketName),
-			Prefix:     aws.String(folderName),
-			StartAfter: aws.String(startAfter),
+	parts := make([]*s3.CompletedPart, 0, size/s.copyPartSize+1)
+	for offset := int64(0); offset < size; offset += s.copyPartSize {
+		partNumber := aws.Int64(int64(len(parts) + 1))
+		input := &s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.bucketName),
+			Key:             aws.String(key),
+			UploadId:        upload.UploadId,
+			PartNumber:      partNumber,
+			CopySource:      s.copySource(sourceKey),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, min(offset+s.copyPartSize, size)-1)),
 		}
-		output, err := s3Config.svc.ListObjectsV2(input)
+		var output *s3.UploadPartCopyOutput
+		err = s.retry.do(ctx, fmt.Sprintf("copy part %d of %s to %s", *partNumber, sourceKey, key), func() error {
+			var err error
+			output, err = s.svc.UploadPartCopyWithContext(ctx, input)
+			return err
+		})
 		if err != nil {
-			return nil, false, fmt.Errorf("listing objects: %w", err)
+			s.abortCopy(ctx, key, upload.UploadId)
+			return err
 		}
+		parts = append(parts, &s3.CompletedPart{ETag: output.CopyPartResult.ETag, PartNumber: partNumber})
+	}
 
-		keys := make([]string, 0, len(output.Contents))
-		for _, obj := range output.Contents {
-			keys = append(keys, *obj.Key)
-		}
+	completeInput := &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucketName),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	}
+	err = s.retry.do(ctx, "complete copy of "+sourceKey+" to "+key, func() error {
+		_, err := s.svc.CompleteMultipartUploadWithContext(ctx, completeInput)
+		return err
+	})
+	if err != nil {
+		s.abortCopy(ctx, key, upload.UploadId)
+		return err
+	}
 
-		return keys, *output.IsTruncated, nil
+	return nil
+}
+
+func (s *s3Storage) abortCopy(ctx context.Context, key string, uploadID *string) {
+	input := &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucketName),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	}
+	ctx = context.WithoutCancel(ctx)
+	err := s.retry.do(ctx, "abort copy to "+key, func() error {
+		_, err := s.svc.AbortMultipartUploadWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		log.WithError(err).Errorf("Cannot abort copy to %s", key)
+	}
+}
+
+// cleanStaging deletes the staging objects of the archives folder which are older than maxAge, e.g. the ones
+// which a crashed run has left behind between uploading and promoting an archive. It returns the number of deleted objects.
+func (s *s3Storage) cleanStaging(ctx context.Context, archivesFolder string, maxAge time.Duration) (int, error) {
+	files, err := s.listFiles(ctx, stagingPrefix(archivesFolder))
+	if err != nil {
+		return 0, err
 	}
 
-	result := make([]string, 0, 32)
-	lastKey := ""
-	for {
-		keys, more, err := listObjects(lastKey)
-		if err != nil {
-			return nil, err
+	deleted := 0
+	for _, file := range files {
+		if time.Since(file.lastModified) < maxAge {
+			continue
 		}
-		result = append(result, keys...)
-		if !more {
-			break
+		if err := s.deleteObject(ctx, file.key); err != nil {
+			return deleted, err
 		}
-		lastKey = keys[len(keys)-1]
+		deleted++
 	}
 
-	log.Infof("Finished fileKeys retrieval from s3 folder name %s. There are %d files", folderName, len(result))
-	return result, nil
+	return deleted, nil
 }
 
-type s3Object interface {
-	Key() string
-	Close() error
-	Read(p []byte) (int, error)
+// s3ReaderAt reads an s3 object with ranged GET requests.
+// The last fetched block is cached, so sequential reads of small chunks do not result in a request each.
+type s3ReaderAt struct {
+	ctx         context.Context
+	storage     *s3Storage
+	key         string
+	size        int64
+	blockSize   int64
+	mu          sync.Mutex
+	block       []byte
+	blockOffset int64
 }
 
-type s3obj struct {
-	data io.ReadCloser
-	key  string
-}
+func (r *s3ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-func (o *s3obj) Key() string {
-	return o.key
-}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+
+		if pos < r.blockOffset || pos >= r.blockOffset+int64(len(r.block)) {
+			if err := r.fetchBlock(pos); err != nil {
+				return n, err
+			}
+		}
+
+		n += copy(p[n:], r.block[pos-r.blockOffset:])
+	}
 
-func (o *s3obj) Close() error {
-	return o.data.Close()
+	return n, nil
 }
 
-func (o *s3obj) Read(p []byte) (int, error) {
-	return o.data.Read(p)
+func (r *s3ReaderAt) fetchBlock(off int64) error {
+	end := off + r.blockSize
+	if end > r.size {
+		end = r.size
+	}
+
+	block, err := r.storage.readRange(r.ctx, r.key, aws.String(fmt.Sprintf("bytes=%d-%d", off, end-1)))
+	if err != nil {
+		return fmt.Errorf("reading bytes %d-%d of file %s: %w", off, end-1, r.key, err)
+	}
+	if len(block) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+
+	r.block = block
+	r.blockOffset = off
+	return nil
 }
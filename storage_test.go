@@ -2,15 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	s3 "github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
@@ -42,6 +53,43 @@ func init() {
 
 type mockS3Client struct {
 	s3iface.S3API
+	uploadedParts  [][]byte
+	completedParts []*s3.CompletedPart
+	aborted        bool
+	getObjectCalls int64
+	headMetadata   map[string]*string
+
+	// objects holds the objects stored with PutObject.
+	// getObjectCalls counts only the downloads of the files in test-folder.
+	mu              sync.Mutex
+	objects         map[string][]byte
+	objectsMetadata map[string]map[string]*string
+	uploadMetadata  map[string]*string
+	// failingKeys holds the keys which cannot be written with PutObject or CopyObject.
+	failingKeys map[string]bool
+	// copiedParts counts the parts which have been copied with UploadPartCopy.
+	copiedParts int
+	// stagedAt is the modification time of the listed staging objects.
+	stagedAt time.Time
+	// checksums holds the SHA-256 checksums of the objects which have been uploaded with one.
+	checksums map[string]string
+	// uploadChecksums tells whether the multipart upload has been started with SHA-256 checksums.
+	uploadChecksums bool
+	// corruptChecksums makes HeadObject return wrong checksums, as if the stored objects did not hold what has been sent.
+	corruptChecksums bool
+	// slowDowns is the number of GetObject calls which are throttled before the objects are returned.
+	slowDowns int64
+	// storedObjectGets counts the downloads of the objects stored with PutObject.
+	storedObjectGets int64
+	// abortedUploads holds the staging keys and the ids of the aborted multipart uploads as <key>#<upload id>.
+	abortedUploads []string
+}
+
+// unreadableBody fails while the object is being downloaded, e.g. when the connection is reset.
+type unreadableBody struct{}
+
+func (unreadableBody) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
 }
 
 func (m *mockS3Client) PutObject(poi *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
@@ -49,26 +97,253 @@ func (m *mockS3Client) PutObject(poi *s3.PutObjectInput) (*s3.PutObjectOutput, e
 		return nil, awserr.New("NoSuchBucket", "The specified bucket does not exist", nil)
 	}
 
-	if *poi.Key == "test-folder/test.zip" {
+	if m.failingKeys[*poi.Key] {
+		return nil, awserr.New("InternalError", "We encountered an internal error. Please try again.", nil)
+	}
+
+	if *poi.Key == stagingKey("test-folder/test.zip") {
 		if *poi.ContentMD5 != testzipMD5 {
 			return nil, awserr.New("BadDigest", "The Content-MD5 you specified did not match what we received.", nil)
 		}
 	}
 
-	return nil, nil
+	data, err := io.ReadAll(poi.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if poi.ChecksumSHA256 != nil && *poi.ChecksumSHA256 != base64SHA256(data) {
+		return nil, awserr.New("BadDigest", "The SHA256 you specified did not match the calculated checksum.", nil)
+	}
+
+	m.storeObject(*poi.Key, data, poi.Metadata)
+	if poi.ChecksumSHA256 != nil {
+		m.storeChecksum(*poi.Key, *poi.ChecksumSHA256)
+	}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *mockS3Client) storeChecksum(key, checksum string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.checksums == nil {
+		m.checksums = make(map[string]string)
+	}
+	m.checksums[key] = checksum
+}
+
+func (m *mockS3Client) storeObject(key string, data []byte, metadata map[string]*string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.objects == nil {
+		m.objects = make(map[string][]byte)
+		m.objectsMetadata = make(map[string]map[string]*string)
+	}
+	m.objects[key] = data
+	m.objectsMetadata[key] = metadata
+}
+
+func (m *mockS3Client) storedChecksum(key string) *string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	checksum, ok := m.checksums[key]
+	if !ok {
+		return nil
+	}
+	if m.corruptChecksums {
+		return aws.String(base64SHA256([]byte(checksum)))
+	}
+	return aws.String(checksum)
+}
+
+func (m *mockS3Client) storedObject(key string) ([]byte, map[string]*string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.objects[key]
+	return data, m.objectsMetadata[key], ok
+}
+
+func (m *mockS3Client) CopyObject(coi *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	if m.failingKeys[*coi.Key] {
+		return nil, awserr.New("InternalError", "We encountered an internal error. Please try again.", nil)
+	}
+
+	data, metadata, ok := m.storedObject(copySourceKey(*coi.CopySource))
+	if !ok {
+		return nil, awserr.NewRequestFailure(awserr.New("NoSuchKey", "The specified key does not exist.", nil), 404, "")
+	}
+
+	if aws.StringValue(coi.MetadataDirective) == s3.MetadataDirectiveReplace {
+		metadata = coi.Metadata
+	}
+	m.storeObject(*coi.Key, data, metadata)
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (m *mockS3Client) UploadPartCopy(upci *s3.UploadPartCopyInput) (*s3.UploadPartCopyOutput, error) {
+	data, _, ok := m.storedObject(copySourceKey(*upci.CopySource))
+	if !ok {
+		return nil, awserr.NewRequestFailure(awserr.New("NoSuchKey", "The specified key does not exist.", nil), 404, "")
+	}
+
+	var from, to int
+	fmt.Sscanf(*upci.CopySourceRange, "bytes=%d-%d", &from, &to)
+	m.copiedParts++
+	m.uploadedParts = append(m.uploadedParts, data[from:to+1])
+	return &s3.UploadPartCopyOutput{
+		CopyPartResult: &s3.CopyPartResult{ETag: aws.String(fmt.Sprintf("copy-etag-%d", *upci.PartNumber))},
+	}, nil
+}
+
+// copySourceKey returns the key of a copy source of the test bucket.
+func copySourceKey(copySource string) string {
+	source, _ := url.PathUnescape(copySource)
+	return strings.TrimPrefix(source[strings.Index(source, "/"):], "/")
+}
+
+func (m *mockS3Client) CreateMultipartUpload(cmui *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	if *cmui.Bucket == nonExistingBucket {
+		return nil, awserr.New("NoSuchBucket", "The specified bucket does not exist", nil)
+	}
+
+	m.uploadMetadata = cmui.Metadata
+	m.uploadChecksums = aws.StringValue(cmui.ChecksumAlgorithm) == s3.ChecksumAlgorithmSha256
+	m.uploadedParts = nil
+	return &s3.CreateMultipartUploadOutput{
+		UploadId: aws.String("upload-id"),
+	}, nil
+}
+
+func (m *mockS3Client) UploadPart(upi *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	data, err := io.ReadAll(upi.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if *upi.ContentMD5 != base64MD5(data) {
+		return nil, awserr.New("BadDigest", "The Content-MD5 you specified did not match what we received.", nil)
+	}
+	if upi.ChecksumSHA256 != nil && *upi.ChecksumSHA256 != base64SHA256(data) {
+		return nil, awserr.New("BadDigest", "The SHA256 you specified did not match the calculated checksum.", nil)
+	}
+
+	//parts are kept by part number, as a resumed upload sends the parts after its checkpoint again
+	n := int(*upi.PartNumber)
+	for len(m.uploadedParts) < n {
+		m.uploadedParts = append(m.uploadedParts, nil)
+	}
+	m.uploadedParts = append(m.uploadedParts[:n-1], data)
+	return &s3.UploadPartOutput{
+		ETag: aws.String(fmt.Sprintf("etag-%d", *upi.PartNumber)),
+	}, nil
+}
+
+func (m *mockS3Client) CompleteMultipartUpload(cmui *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	m.completedParts = cmui.MultipartUpload.Parts
+	m.storeObject(*cmui.Key, bytes.Join(m.uploadedParts, nil), m.uploadMetadata)
+	if m.uploadChecksums {
+		//s3 keeps the checksum of the checksums of the parts of a multipart upload
+		hash := sha256.New()
+		for _, part := range m.uploadedParts {
+			checksum := sha256.Sum256(part)
+			hash.Write(checksum[:])
+		}
+		m.storeChecksum(*cmui.Key, fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(hash.Sum(nil)), len(m.uploadedParts)))
+	}
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *mockS3Client) ListParts(lpi *s3.ListPartsInput) (*s3.ListPartsOutput, error) {
+	if *lpi.UploadId != "upload-id" {
+		return nil, awserr.NewRequestFailure(awserr.New("NoSuchUpload", "The specified upload does not exist.", nil), 404, "")
+	}
+
+	return &s3.ListPartsOutput{}, nil
+}
+
+func (m *mockS3Client) DeleteObject(doi *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.objects, *doi.Key)
+	delete(m.objectsMetadata, *doi.Key)
+	delete(m.checksums, *doi.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *mockS3Client) AbortMultipartUpload(amui *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.aborted = true
+	m.abortedUploads = append(m.abortedUploads, *amui.Key+"#"+*amui.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (m *mockS3Client) HeadObject(hoi *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if data, metadata, ok := m.storedObject(*hoi.Key); ok {
+		output := &s3.HeadObjectOutput{
+			ContentLength: aws.Int64(int64(len(data))),
+			Metadata:      metadata,
+		}
+		if aws.StringValue(hoi.ChecksumMode) == s3.ChecksumModeEnabled {
+			output.ChecksumSHA256 = m.storedChecksum(*hoi.Key)
+		}
+		return output, nil
+	}
+
+	if m.headMetadata == nil {
+		return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), 404, "")
+	}
+
+	return &s3.HeadObjectOutput{
+		Metadata: m.headMetadata,
+	}, nil
 }
 
 func (m *mockS3Client) GetObject(goi *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if atomic.AddInt64(&m.slowDowns, -1) >= 0 {
+		return nil, awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, "")
+	}
+
+	if data, _, ok := m.storedObject(*goi.Key); ok {
+		atomic.AddInt64(&m.storedObjectGets, 1)
+		if goi.Range != nil {
+			var from, to int
+			fmt.Sscanf(*goi.Range, "bytes=%d-%d", &from, &to)
+			data = data[from : to+1]
+		}
+
+		return &s3.GetObjectOutput{
+			Body: io.NopCloser(bytes.NewReader(data)),
+		}, nil
+	}
+
 	if *goi.Key == validFileName {
 		return &s3.GetObjectOutput{
 			Body: io.NopCloser(bytes.NewReader([]byte("contents"))),
 		}, nil
 	}
+	if strings.HasPrefix(*goi.Key, "test-folder/unreadable") {
+		return &s3.GetObjectOutput{
+			Body: io.NopCloser(unreadableBody{}),
+		}, nil
+	}
+	if strings.HasPrefix(*goi.Key, "test-folder/") {
+		atomic.AddInt64(&m.getObjectCalls, 1)
+		return &s3.GetObjectOutput{
+			Body: io.NopCloser(strings.NewReader(*goi.Key)),
+		}, nil
+	}
 	if *goi.Key == invalidFileName {
 		return nil, awserr.New("NoSuchKey", "The specified key does not exist.", nil)
 	}
 
-	return nil, errors.New("error")
+	return nil, awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "")
 }
 
 func (m *mockS3Client) ListObjectsV2(loi *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
@@ -91,7 +366,8 @@ func (m *mockS3Client) ListObjectsV2(loi *s3.ListObjectsV2Input) (*s3.ListObject
 
 		for i := from; i < to; i++ {
 			contents = append(contents, &s3.Object{
-				Key: &testFolderFiles[i],
+				Key:  &testFolderFiles[i],
+				ETag: aws.String(fmt.Sprintf("\"etag-%d\"", i)),
 			})
 		}
 
@@ -100,34 +376,170 @@ func (m *mockS3Client) ListObjectsV2(loi *s3.ListObjectsV2Input) (*s3.ListObject
 			Contents:    contents,
 		}, nil
 	}
+	if strings.HasSuffix(*loi.Prefix, "/"+stagingFolderName+"/") {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		var contents []*s3.Object
+		for key := range m.objects {
+			if strings.HasPrefix(key, *loi.Prefix) {
+				contents = append(contents, &s3.Object{Key: aws.String(key), LastModified: aws.Time(m.stagedAt)})
+			}
+		}
+		return &s3.ListObjectsV2Output{
+			IsTruncated: aws.Bool(false),
+			Contents:    contents,
+		}, nil
+	}
 	if *loi.Prefix == "empty-folder" {
 		return &s3.ListObjectsV2Output{
 			IsTruncated: aws.Bool(false),
 		}, nil
 	}
 
-	return nil, errors.New("error")
+	return nil, awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "")
+}
+
+// The WithContext variants fail like the sdk once the context is cancelled, otherwise they behave as the plain calls.
+func canceledRequest(ctx aws.Context) error {
+	if err := ctx.Err(); err != nil {
+		return awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+	return nil
+}
+
+func (m *mockS3Client) PutObjectWithContext(ctx aws.Context, poi *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	if err := canceledRequest(ctx); err != nil {
+		return nil, err
+	}
+	return m.PutObject(poi)
+}
+
+func (m *mockS3Client) CopyObjectWithContext(ctx aws.Context, coi *s3.CopyObjectInput, _ ...request.Option) (*s3.CopyObjectOutput, error) {
+	if err := canceledRequest(ctx); err != nil {
+		return nil, err
+	}
+	return m.CopyObject(coi)
+}
+
+func (m *mockS3Client) UploadPartCopyWithContext(ctx aws.Context, upci *s3.UploadPartCopyInput, _ ...request.Option) (*s3.UploadPartCopyOutput, error) {
+	if err := canceledRequest(ctx); err != nil {
+		return nil, err
+	}
+	return m.UploadPartCopy(upci)
+}
+
+func (m *mockS3Client) CreateMultipartUploadWithContext(ctx aws.Context, cmui *s3.CreateMultipartUploadInput, _ ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	if err := canceledRequest(ctx); err != nil {
+		return nil, err
+	}
+	return m.CreateMultipartUpload(cmui)
+}
+
+func (m *mockS3Client) UploadPartWithContext(ctx aws.Context, upi *s3.UploadPartInput, _ ...request.Option) (*s3.UploadPartOutput, error) {
+	if err := canceledRequest(ctx); err != nil {
+		return nil, err
+	}
+	return m.UploadPart(upi)
+}
+
+func (m *mockS3Client) CompleteMultipartUploadWithContext(ctx aws.Context, cmui *s3.CompleteMultipartUploadInput, _ ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	if err := canceledRequest(ctx); err != nil {
+		return nil, err
+	}
+	return m.CompleteMultipartUpload(cmui)
+}
+
+func (m *mockS3Client) AbortMultipartUploadWithContext(ctx aws.Context, amui *s3.AbortMultipartUploadInput, _ ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	if err := canceledRequest(ctx); err != nil {
+		return nil, err
+	}
+	return m.AbortMultipartUpload(amui)
+}
+
+func (m *mockS3Client) ListPartsWithContext(ctx aws.Context, lpi *s3.ListPartsInput, _ ...request.Option) (*s3.ListPartsOutput, error) {
+	if err := canceledRequest(ctx); err != nil {
+		return nil, err
+	}
+	return m.ListParts(lpi)
+}
+
+func (m *mockS3Client) DeleteObjectWithContext(ctx aws.Context, doi *s3.DeleteObjectInput, _ ...request.Option) (*s3.DeleteObjectOutput, error) {
+	if err := canceledRequest(ctx); err != nil {
+		return nil, err
+	}
+	return m.DeleteObject(doi)
+}
+
+func (m *mockS3Client) HeadObjectWithContext(ctx aws.Context, hoi *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	if err := canceledRequest(ctx); err != nil {
+		return nil, err
+	}
+	return m.HeadObject(hoi)
+}
+
+func (m *mockS3Client) GetObjectWithContext(ctx aws.Context, goi *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	if err := canceledRequest(ctx); err != nil {
+		return nil, err
+	}
+	return m.GetObject(goi)
+}
+
+// ListObjectsV2PagesWithContext follows the pages of ListObjectsV2 by their last key.
+func (m *mockS3Client) ListObjectsV2PagesWithContext(ctx aws.Context, loi *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+	input := *loi
+	input.StartAfter = aws.String("")
+	for {
+		if err := canceledRequest(ctx); err != nil {
+			return err
+		}
+
+		output, err := m.ListObjectsV2(&input)
+		if err != nil {
+			return err
+		}
+
+		lastPage := !aws.BoolValue(output.IsTruncated)
+		if !fn(output, lastPage) || lastPage {
+			return nil
+		}
+		input.StartAfter = output.Contents[len(output.Contents)-1].Key
+	}
 }
 
 func TestDownloadFileHappyFlow(t *testing.T) {
 	s3Config := newS3Config(&mockS3Client{}, "test-bucket", "")
 
-	downloadedFile, err := s3Config.downloadFile(validFileName, 2)
+	downloadedFile := s3Config.downloadFileContents(context.Background(), validFileName)
 
-	assert.Nil(t, err)
-	assert.NotNil(t, downloadedFile)
+	assert.Nil(t, downloadedFile.err)
+	assert.Equal(t, "contents", string(downloadedFile.data))
 }
 
 func TestDownloadFileWithInvalidFileName(t *testing.T) {
 	s3Config := newS3Config(&mockS3Client{}, "test-bucket", "")
 
-	downloadedFile, err := s3Config.downloadFile(invalidFileName, 3)
+	start := time.Now()
+	downloadedFile := s3Config.downloadFileContents(context.Background(), invalidFileName)
+
+	assert.NotNil(t, downloadedFile.err)
+	assert.Nil(t, downloadedFile.data)
+	assert.True(t, time.Since(start) < time.Second, "missing file should not be retried")
+}
+
+func TestDownloadFileRetriesThrottledRequests(t *testing.T) {
+	mockClient := &mockS3Client{slowDowns: 2}
+	bucket := newS3Storage(mockClient, "test-bucket")
+	bucket.retry = newTestRetryPolicy()
+	s3Config := newStorageConfig(bucket, "")
+
+	downloadedFile := s3Config.downloadFileContents(context.Background(), validFileName)
 
-	assert.NotNil(t, err)
-	assert.Nil(t, downloadedFile)
+	assert.Nil(t, downloadedFile.err)
+	assert.Equal(t, "contents", string(downloadedFile.data))
 }
 
-func TestUploadFile(t *testing.T) {
+func TestArchiveUpload(t *testing.T) {
 	tests := map[string]struct {
 		bucketName string
 		sourceName string
@@ -137,14 +549,9 @@ func TestUploadFile(t *testing.T) {
 			bucketName: "archives",
 			sourceName: testzipPath,
 		},
-		"NoExistingFile": {
-			bucketName: "archives",
-			sourceName: nonExistingZip,
-			expErr:     true,
-		},
 		"ErrFromS3Client": {
 			bucketName: "fake-bucket",
-			sourceName: "",
+			sourceName: testzipPath,
 			expErr:     true,
 		},
 	}
@@ -152,7 +559,17 @@ func TestUploadFile(t *testing.T) {
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
 			s3Config := newS3Config(&mockS3Client{}, test.bucketName, "test-folder")
-			err := s3Config.uploadFile(test.sourceName, "test.zip")
+			data, err := os.ReadFile(test.sourceName)
+			if err != nil {
+				t.Fatalf("cannot read test data: %s", err)
+			}
+
+			upload := s3Config.newArchiveUpload(context.Background(), "test.zip", nil)
+			_, err = upload.Write(data)
+			if err != nil {
+				t.Fatalf("did not expect error, got: %s", err)
+			}
+			err = upload.Close()
 
 			if err == nil && test.expErr {
 				t.Fatalf("expected error, did not get one")
@@ -164,7 +581,209 @@ func TestUploadFile(t *testing.T) {
 	}
 }
 
-func TestGetFileKeys(t *testing.T) {
+func TestArchiveUploadMultipart(t *testing.T) {
+	mockClient := &mockS3Client{}
+	bucket := newS3Storage(mockClient, "archives")
+	bucket.partSize = 4
+	s3Config := newStorageConfig(bucket, "test-folder")
+
+	upload := s3Config.newArchiveUpload(context.Background(), "test.zip", nil)
+	_, err := upload.Write([]byte("0123456"))
+	assert.Nil(t, err)
+	_, err = upload.Write([]byte("789"))
+	assert.Nil(t, err)
+	assert.Len(t, mockClient.uploadedParts, 2)
+
+	err = upload.Close()
+
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("0123"), []byte("4567"), []byte("89")}, mockClient.uploadedParts)
+	assert.Len(t, mockClient.completedParts, 3)
+	assert.Equal(t, int64(10), upload.archiveSize())
+}
+
+func TestArchiveUploadAbort(t *testing.T) {
+	mockClient := &mockS3Client{}
+	bucket := newS3Storage(mockClient, "archives")
+	bucket.partSize = 4
+	s3Config := newStorageConfig(bucket, "test-folder")
+
+	upload := s3Config.newArchiveUpload(context.Background(), "test.zip", nil)
+	_, err := upload.Write([]byte("0123456789"))
+	assert.Nil(t, err)
+
+	err = upload.Abort()
+
+	assert.Nil(t, err)
+	assert.True(t, mockClient.aborted)
+	assert.Nil(t, mockClient.completedParts)
+}
+
+func TestArchiveUploadAbortAfterCancel(t *testing.T) {
+	mockClient := &mockS3Client{}
+	bucket := newS3Storage(mockClient, "archives")
+	bucket.partSize = 4
+	s3Config := newStorageConfig(bucket, "test-folder")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	upload := s3Config.newArchiveUpload(ctx, "test.zip", nil)
+	_, err := upload.Write([]byte("0123456789"))
+	assert.Nil(t, err)
+
+	cancel()
+	assert.NotNil(t, upload.Close())
+	err = upload.Abort()
+
+	assert.Nil(t, err)
+	assert.True(t, mockClient.aborted)
+	assert.Nil(t, mockClient.completedParts)
+}
+
+func TestArchiveUploadPromotesStagingObject(t *testing.T) {
+	tests := map[string]struct {
+		maxCopySize     int64
+		wantCopiedParts int
+	}{
+		"CopyObject": {
+			maxCopySize: defaultMaxCopySize,
+		},
+		"UploadPartCopy": {
+			maxCopySize:     4,
+			wantCopiedParts: 3,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			mockClient := &mockS3Client{}
+			bucket := newS3Storage(mockClient, "archives")
+			bucket.partSize = 4
+			bucket.maxCopySize = test.maxCopySize
+			bucket.copyPartSize = 4
+			metadata := map[string]*string{"source-count": aws.String("2")}
+
+			upload := bucket.putArchive(context.Background(), "archives/test.zip", metadata)
+			_, err := upload.Write([]byte("0123456789"))
+			assert.Nil(t, err)
+			_, _, ok := mockClient.storedObject("archives/test.zip")
+			assert.False(t, ok, "archive should not be published before it is complete")
+
+			assert.Nil(t, upload.Close())
+
+			data, storedMetadata, ok := mockClient.storedObject("archives/test.zip")
+			assert.True(t, ok)
+			assert.Equal(t, "0123456789", string(data))
+			assert.Equal(t, metadata, storedMetadata)
+			assert.Equal(t, test.wantCopiedParts, mockClient.copiedParts)
+			_, _, ok = mockClient.storedObject(stagingKey("archives/test.zip"))
+			assert.False(t, ok, "staging object should be deleted once it is promoted")
+		})
+	}
+}
+
+func TestArchiveUploadPromotionFailure(t *testing.T) {
+	mockClient := &mockS3Client{failingKeys: map[string]bool{"archives/test.zip": true}}
+	bucket := newS3Storage(mockClient, "archives")
+	bucket.retry = newTestRetryPolicy()
+
+	upload := bucket.putArchive(context.Background(), "archives/test.zip", nil)
+	_, err := upload.Write([]byte("0123456789"))
+	assert.Nil(t, err)
+	assert.Error(t, upload.Close())
+	_, _, ok := mockClient.storedObject(stagingKey("archives/test.zip"))
+	assert.True(t, ok)
+
+	assert.Nil(t, upload.Abort())
+	_, _, ok = mockClient.storedObject(stagingKey("archives/test.zip"))
+	assert.False(t, ok, "staging object should be deleted when the upload is aborted")
+	_, _, ok = mockClient.storedObject("archives/test.zip")
+	assert.False(t, ok)
+}
+
+func TestArchiveUploadVerifiesStagingChecksum(t *testing.T) {
+	tests := map[string]struct {
+		partSize int
+	}{
+		"SinglePut": {
+			partSize: defaultUploadPartSize,
+		},
+		"Multipart": {
+			partSize: 4,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			mockClient := &mockS3Client{corruptChecksums: true}
+			bucket := newS3Storage(mockClient, "archives")
+			bucket.partSize = test.partSize
+			bucket.retry = newTestRetryPolicy()
+
+			upload := bucket.putArchive(context.Background(), "archives/test.zip", nil)
+			_, err := upload.Write([]byte("0123456789"))
+			assert.Nil(t, err)
+			err = upload.Close()
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "SHA-256 checksum")
+
+			_, _, ok := mockClient.storedObject("archives/test.zip")
+			assert.False(t, ok, "a corrupt staging object should not be published")
+		})
+	}
+}
+
+func TestStagingKey(t *testing.T) {
+	assert.Equal(t, "archives/.staging/FT-archive-2016.zip", stagingKey("archives/FT-archive-2016.zip"))
+	assert.Equal(t, ".staging/FT-archive-2016.zip", stagingKey("FT-archive-2016.zip"))
+	assert.Equal(t, "archives/.staging/", stagingPrefix("archives"))
+}
+
+func TestCleanStaging(t *testing.T) {
+	tests := map[string]struct {
+		stagedAt    time.Time
+		wantDeleted int
+	}{
+		"Stale": {
+			stagedAt:    time.Now().Add(-2 * defaultStagingMaxAge),
+			wantDeleted: 2,
+		},
+		"InProgress": {
+			stagedAt: time.Now(),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			mockClient := &mockS3Client{stagedAt: test.stagedAt}
+			mockClient.storeObject(stagingKey("archives/FT-archive-2016.zip"), []byte("2016"), nil)
+			mockClient.storeObject(stagingKey("archives/FT-archive-2017.zip"), []byte("2017"), nil)
+			mockClient.storeObject("archives/FT-archive-2016.zip", []byte("2016"), nil)
+
+			deleted, err := newS3Storage(mockClient, "test-bucket").cleanStaging(context.Background(), "archives", defaultStagingMaxAge)
+
+			assert.Nil(t, err)
+			assert.Equal(t, test.wantDeleted, deleted)
+			assert.Len(t, mockClient.objects, 3-test.wantDeleted)
+			_, _, ok := mockClient.storedObject("archives/FT-archive-2016.zip")
+			assert.True(t, ok)
+		})
+	}
+}
+
+func TestDownloadFileCancelled(t *testing.T) {
+	s3Config := newS3Config(&mockS3Client{}, "test-bucket", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	downloadedFile := s3Config.downloadFileContents(ctx, validFileName)
+
+	assert.NotNil(t, downloadedFile.err)
+	assert.Nil(t, downloadedFile.data)
+	assert.True(t, time.Since(start) < time.Second, "cancelled download should not be retried")
+}
+
+func TestListFiles(t *testing.T) {
 	tests := map[string]struct {
 		bucketName string
 		folderName string
@@ -190,7 +809,11 @@ func TestGetFileKeys(t *testing.T) {
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
 			s3Config := newS3Config(&mockS3Client{}, test.bucketName, "archives")
-			got, err := s3Config.getFileKeys(test.folderName)
+			files, err := s3Config.listFiles(context.Background(), test.folderName)
+			var got []string
+			for _, file := range files {
+				got = append(got, file.key)
+			}
 
 			if err != nil && !test.expErr {
 				t.Fatalf("did not expect error, got: %s", err)
@@ -199,22 +822,7 @@ func TestGetFileKeys(t *testing.T) {
 				t.Fatalf("expected error, did not get one")
 			}
 
-			if !equalSlices(got, test.want) {
-				t.Fatalf("want: %v, got: %v", test.want, got)
-			}
+			assert.Equal(t, test.want, got)
 		})
 	}
 }
-
-func equalSlices(a, b []string) bool {
-	if len(a) != len(b) {
-		return false
-	}
-
-	for i := 0; i < len(a); i++ {
-		if a[i] != b[i] {
-			return false
-		}
-	}
-	return true
-}
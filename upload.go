@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	s3 "github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// S3 requires every part except the last one to be at least 5MiB.
+// With 8MiB parts a single archive can grow up to ~80GiB before hitting the 10000 parts limit.
+// Every archive which is being written holds a part in memory for each of its s3 sinks,
+// so the number of archives of a folder which are written at the same time is limited by maxOpenArchives.
+const defaultUploadPartSize = 8 * 1024 * 1024
+
+// defaultMaxOpenArchives is the number of archives of a folder which are written at the same time by default.
+const defaultMaxOpenArchives = 24
+
+// archiveUpload streams an archive to a storage while it is being written.
+type archiveUpload interface {
+	io.WriteCloser
+	// stage finishes the upload without publishing the archive under its key, Close publishes it.
+	stage() error
+	// Abort discards everything which has been uploaded so far.
+	Abort() error
+	// checkpoint returns the state of the upload, so a later run can resume it.
+	checkpoint() (uploadCheckpoint, error)
+	resume(checkpoint uploadCheckpoint) error
+	// setMetadata replaces the metadata the archive is published with, e.g. once it is known which files it holds.
+	setMetadata(metadata map[string]*string)
+	archiveKey() string
+	// archiveSize and sha256 describe everything which has been written to the upload.
+	archiveSize() int64
+	sha256() string
+}
+
+// s3Upload streams an archive to S3 while it is being written.
+// Data is buffered until a whole part is collected and that part is sent with UploadPart,
+// so memory usage does not depend on the size of the archive.
+// Archives which are smaller than a single part are sent with one PutObject call on Close.
+// The archive is uploaded to a staging key and only copied to its key once it is complete,
+// so the key of the archive always holds a complete archive, even while a run is uploading a new one.
+type s3Upload struct {
+	ctx        context.Context
+	storage    *s3Storage
+	fileName   string
+	key        string
+	stagingKey string
+	// staged tells whether the staging object has been uploaded but not promoted to the key of the archive.
+	staged bool
+	// verified tells whether the staging object has been checked to hold what has been sent.
+	verified bool
+	metadata map[string]*string
+	buf      bytes.Buffer
+	hash     hash.Hash
+	uploadID *string
+	parts    []*s3.CompletedPart
+	size     int64
+}
+
+func newS3Upload(ctx context.Context, storage *s3Storage, key string, metadata map[string]*string) *s3Upload {
+	return &s3Upload{
+		ctx:        ctx,
+		storage:    storage,
+		fileName:   path.Base(key),
+		key:        key,
+		stagingKey: stagingKey(key),
+		metadata:   metadata,
+		hash:       sha256.New(),
+	}
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	u.hash.Write(p)
+	n, _ := u.buf.Write(p)
+	for u.buf.Len() >= u.storage.partSize {
+		if err := u.uploadPart(u.buf.Next(u.storage.partSize)); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Close stages the archive, unless it has already been staged, and promotes it.
+func (u *s3Upload) Close() error {
+	err := u.stage()
+	if err != nil {
+		return err
+	}
+
+	return u.promote()
+}
+
+// stage sends the remaining buffered data, completes the upload of the staging object and verifies it.
+// The staging object is verified by its size and by the SHA-256 checksum s3 has computed for it,
+// which has to match the checksum of the data the upload has sent. S3 compatible stores which do not keep checksums
+// are only checked by size.
+func (u *s3Upload) stage() error {
+	if u.verified {
+		return nil
+	}
+
+	err := u.complete()
+	if err != nil {
+		return err
+	}
+	u.staged = true
+
+	head, err := u.storage.headObject(u.ctx, u.stagingKey)
+	if err != nil {
+		return fmt.Errorf("could not verify staged file with name %s: %w", u.fileName, err)
+	}
+	if head.size != u.size {
+		return fmt.Errorf("staged file with name %s has %d bytes instead of %d", u.fileName, head.size, u.size)
+	}
+	if head.checksumSHA256 == "" {
+		log.Warnf("Staged file %s has no SHA-256 checksum, it is only verified by its size", u.stagingKey)
+	} else if checksum := u.stagedChecksum(); head.checksumSHA256 != checksum {
+		return fmt.Errorf("staged file with name %s has SHA-256 checksum %s instead of %s", u.fileName, head.checksumSHA256, checksum)
+	}
+
+	u.verified = true
+	return nil
+}
+
+func (u *s3Upload) complete() error {
+	if u.uploadID == nil {
+		return u.putObject(u.buf.Bytes())
+	}
+
+	if u.buf.Len() > 0 {
+		if err := u.uploadPart(u.buf.Next(u.buf.Len())); err != nil {
+			return err
+		}
+	}
+
+	input := &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(u.storage.bucketName),
+		Key:      aws.String(u.stagingKey),
+		UploadId: u.uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: u.parts,
+		},
+	}
+	err := u.storage.retry.do(u.ctx, "complete upload of "+u.stagingKey, func() error {
+		_, err := u.storage.svc.CompleteMultipartUploadWithContext(u.ctx, input)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not complete upload of file with name %s to s3: %w", u.fileName, err)
+	}
+
+	log.Infof("Finished uploading file %s to s3 in %d parts. Size: %d bytes", u.fileName, len(u.parts), u.size)
+	return nil
+}
+
+// promote copies the verified staging object to the key of the archive with a server-side copy,
+// which replaces the previous archive at once. The copy gets the current metadata of the upload,
+// as the staging object carries the metadata the upload has been started with.
+// The staging object is deleted once it has been copied.
+func (u *s3Upload) promote() error {
+	var err error
+	if u.size > u.storage.maxCopySize {
+		err = u.storage.copyObjectInParts(u.ctx, u.stagingKey, u.key, u.size, u.metadata)
+	} else {
+		err = u.storage.copyObject(u.ctx, u.stagingKey, u.key, u.metadata)
+	}
+	if err != nil {
+		return fmt.Errorf("could not promote staged file with name %s: %w", u.fileName, err)
+	}
+	u.staged = false
+
+	err = u.storage.deleteObject(u.ctx, u.stagingKey)
+	if err != nil {
+		log.WithError(err).Warnf("Cannot delete staged file %s, it will be cleaned up by a later run", u.stagingKey)
+	}
+
+	log.Infof("Published file %s to s3 as %s", u.fileName, u.key)
+	return nil
+}
+
+// stagedChecksum returns the SHA-256 checksum s3 computes for the staging object: the checksum of the whole object
+// if it has been sent with a single PutObject call, the checksum of the checksums of the parts otherwise.
+func (u *s3Upload) stagedChecksum() string {
+	if u.uploadID == nil {
+		return base64.StdEncoding.EncodeToString(u.hash.Sum(nil))
+	}
+
+	hash := sha256.New()
+	for _, part := range u.parts {
+		checksum, _ := base64.StdEncoding.DecodeString(aws.StringValue(part.ChecksumSHA256))
+		hash.Write(checksum)
+	}
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(hash.Sum(nil)), len(u.parts))
+}
+
+// Abort discards everything which has been uploaded so far.
+// It is safe to call it even if no part has been sent yet.
+// The upload is aborted even if its context has been cancelled, e.g. on SIGTERM,
+// so no incomplete multipart upload is left behind. A staging object which has not been promoted is deleted.
+func (u *s3Upload) Abort() error {
+	u.buf.Reset()
+	if u.staged {
+		err := u.storage.deleteObject(context.WithoutCancel(u.ctx), u.stagingKey)
+		if err != nil {
+			return fmt.Errorf("could not delete staged file with name %s from s3: %w", u.fileName, err)
+		}
+		u.staged = false
+		return nil
+	}
+	if u.uploadID == nil {
+		return nil
+	}
+
+	err := u.storage.abortMultipartUpload(context.WithoutCancel(u.ctx), u.stagingKey, *u.uploadID)
+	if err != nil {
+		return fmt.Errorf("could not abort upload of file with name %s to s3: %w", u.fileName, err)
+	}
+
+	u.uploadID = nil
+	u.parts = nil
+	return nil
+}
+
+func (u *s3Upload) putObject(data []byte) error {
+	log.Infof("Uploading file %s to s3...", u.fileName)
+
+	err := u.storage.retry.do(u.ctx, "put "+u.stagingKey, func() error {
+		input := &s3.PutObjectInput{
+			Bucket:   aws.String(u.storage.bucketName),
+			Key:      aws.String(u.stagingKey),
+			Metadata: u.metadata,
+			Body:     bytes.NewReader(data),
+
+			// Optional: integrity check to verify that the data is the same data
+			// that was originally sent.
+			ContentMD5:     aws.String(base64MD5(data)),
+			ChecksumSHA256: aws.String(base64SHA256(data)),
+		}
+		_, err := u.storage.svc.PutObjectWithContext(u.ctx, input)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not upload file with name %s to s3:%w", u.fileName, err)
+	}
+
+	u.size = int64(len(data))
+	log.Infof("Finished uploading file %s to s3", u.fileName)
+	return nil
+}
+
+func (u *s3Upload) uploadPart(data []byte) error {
+	if u.uploadID == nil {
+		log.Infof("Starting multipart upload of file %s to s3...", u.fileName)
+
+		input := &s3.CreateMultipartUploadInput{
+			Bucket:            aws.String(u.storage.bucketName),
+			Key:               aws.String(u.stagingKey),
+			Metadata:          u.metadata,
+			ChecksumAlgorithm: aws.String(s3.ChecksumAlgorithmSha256),
+		}
+		var output *s3.CreateMultipartUploadOutput
+		err := u.storage.retry.do(u.ctx, "start upload of "+u.stagingKey, func() error {
+			var err error
+			output, err = u.storage.svc.CreateMultipartUploadWithContext(u.ctx, input)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("could not start upload of file with name %s to s3: %w", u.fileName, err)
+		}
+		u.uploadID = output.UploadId
+	}
+
+	partNumber := aws.Int64(int64(len(u.parts) + 1))
+	checksum := aws.String(base64SHA256(data))
+	var output *s3.UploadPartOutput
+	err := u.storage.retry.do(u.ctx, fmt.Sprintf("upload part %d of %s", *partNumber, u.stagingKey), func() error {
+		input := &s3.UploadPartInput{
+			Bucket:         aws.String(u.storage.bucketName),
+			Key:            aws.String(u.stagingKey),
+			UploadId:       u.uploadID,
+			PartNumber:     partNumber,
+			Body:           bytes.NewReader(data),
+			ContentMD5:     aws.String(base64MD5(data)),
+			ChecksumSHA256: checksum,
+		}
+		var err error
+		output, err = u.storage.svc.UploadPartWithContext(u.ctx, input)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not upload part %d of file with name %s to s3: %w", *partNumber, u.fileName, err)
+	}
+
+	u.parts = append(u.parts, &s3.CompletedPart{
+		ETag:           output.ETag,
+		PartNumber:     partNumber,
+		ChecksumSHA256: checksum,
+	})
+	u.size += int64(len(data))
+	log.Debugf("Uploaded part %d of file %s to s3", *partNumber, u.fileName)
+	return nil
+}
+
+// checkpoint returns the state of the upload. The buffered data which has not been sent yet is part of it,
+// as S3 does not accept parts smaller than 5MiB.
+func (u *s3Upload) checkpoint() (uploadCheckpoint, error) {
+	hashState, err := u.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return uploadCheckpoint{}, err
+	}
+
+	checkpoint := uploadCheckpoint{
+		UploadID:  aws.StringValue(u.uploadID),
+		Parts:     make([]uploadedPart, 0, len(u.parts)),
+		Size:      u.size,
+		Pending:   append([]byte(nil), u.buf.Bytes()...),
+		HashState: hashState,
+	}
+	for _, part := range u.parts {
+		checkpoint.Parts = append(checkpoint.Parts, uploadedPart{
+			PartNumber:     aws.Int64Value(part.PartNumber),
+			ETag:           aws.StringValue(part.ETag),
+			ChecksumSHA256: aws.StringValue(part.ChecksumSHA256),
+		})
+	}
+
+	return checkpoint, nil
+}
+
+// resume continues the upload from a checkpoint of a previous run.
+// Incomplete multipart uploads may have been aborted in the meantime, e.g. by a lifecycle rule,
+// so the upload is looked up first.
+func (u *s3Upload) resume(checkpoint uploadCheckpoint) error {
+	for _, part := range checkpoint.Parts {
+		if part.ChecksumSHA256 == "" {
+			return fmt.Errorf("checkpoint of file with name %s has no checksum of part %d", u.fileName, part.PartNumber)
+		}
+	}
+
+	if checkpoint.UploadID != "" {
+		input := &s3.ListPartsInput{
+			Bucket:   aws.String(u.storage.bucketName),
+			Key:      aws.String(u.stagingKey),
+			UploadId: aws.String(checkpoint.UploadID),
+			MaxParts: aws.Int64(1),
+		}
+		err := u.storage.retry.do(u.ctx, "list parts of "+u.stagingKey, func() error {
+			_, err := u.storage.svc.ListPartsWithContext(u.ctx, input)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("cannot find upload of file with name %s: %w", u.fileName, err)
+		}
+	}
+
+	err := u.hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(checkpoint.HashState)
+	if err != nil {
+		return fmt.Errorf("cannot restore checksum of file with name %s: %w", u.fileName, err)
+	}
+
+	if checkpoint.UploadID != "" {
+		u.uploadID = aws.String(checkpoint.UploadID)
+	}
+	u.parts = make([]*s3.CompletedPart, 0, len(checkpoint.Parts))
+	for _, part := range checkpoint.Parts {
+		u.parts = append(u.parts, &s3.CompletedPart{
+			PartNumber:     aws.Int64(part.PartNumber),
+			ETag:           aws.String(part.ETag),
+			ChecksumSHA256: aws.String(part.ChecksumSHA256),
+		})
+	}
+	u.size = checkpoint.Size
+	u.buf.Reset()
+	u.buf.Write(checkpoint.Pending)
+
+	log.Infof("Resuming upload of file %s to s3 after %d parts", u.fileName, len(u.parts))
+	return nil
+}
+
+func (u *s3Upload) setMetadata(metadata map[string]*string) {
+	u.metadata = metadata
+}
+
+func (u *s3Upload) archiveKey() string {
+	return u.key
+}
+
+func (u *s3Upload) archiveSize() int64 {
+	return u.size
+}
+
+func (u *s3Upload) sha256() string {
+	return hex.EncodeToString(u.hash.Sum(nil))
+}
+
+func base64SHA256(data []byte) string {
+	hash := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func base64MD5(data []byte) string {
+	hash := md5.Sum(data)
+	// EncodeToString want slice, not array
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
@@ -1,166 +1,438 @@
 package main
 
 import (
-	"archive/zip"
-	"errors"
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
+	"path"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	dateFormat = "2006-01-02"
+
+	allFilesSelectorName      = "all"
+	yearSelectorName          = "year"
+	monthSelectorName         = "month"
+	quarterSelectorName       = "quarter"
+	rollingWindowSelectorName = "rolling-window"
+	dateRangeSelectorName     = "date-range"
+	globSelectorName          = "glob"
+	undatedSelectorName       = "undated"
 )
 
 type zipConfig struct {
 	zipName        string
+	format         *archiveFormat
+	selectorName   string
 	fileSelectorFn fileSelector
 	year           int
-	fileKeys       []string
+	// sourceFolder is the s3 folder the files of the archive are selected from.
+	sourceFolder string
+	// archivesFolder is the s3 folder the archive is uploaded to.
+	// The archives folder of the s3Config is used when it is empty.
+	archivesFolder string
+	// extractDate extracts the publish dates of the source files for the manifest.
+	extractDate dateExtractor
+	// maxUnreadableFiles is the number of files which cannot be downloaded that are left out
+	// of the archive before the archive fails.
+	maxUnreadableFiles int
 }
 
-type fileSelector func(year int, s3ObjectKey string) (bool, error)
+type fileSelector func(s3ObjectKey string) (bool, error)
 
-func newZipConfig(zipName string, fileSelectorFn fileSelector, year int, fileKeys []string) *zipConfig {
+// newZipConfig creates the config of an archive. Its file name is the provided name
+// followed by the extension of the format.
+func newZipConfig(name string, format *archiveFormat, selectorName string, fileSelectorFn fileSelector, year int) *zipConfig {
 	return &zipConfig{
-		zipName:        zipName,
+		zipName:        name + format.extension,
+		format:         format,
+		selectorName:   selectorName,
 		fileSelectorFn: fileSelectorFn,
 		year:           year,
-		fileKeys:       fileKeys,
+		extractDate:    extractDateFromS3ObjectKey,
 	}
 }
 
-func zipAndUploadFiles(s3Config *s3Config, zipConfig *zipConfig, done chan bool, errsCh chan error) {
-	defer func() {
-		done <- true
-	}()
-
-	tempZipFileName, noOfZippedFiles, err := createZipFiles(s3Config, zipConfig)
-	defer os.Remove(tempZipFileName)
-
-	if err != nil {
-		errsCh <- fmt.Errorf("Zip creation failed for zip with name %s. Error was: %s", zipConfig.zipName, err)
-		return
+// zipAndUploadFiles creates all the archives for the provided files in a single pass
+// and uploads them to s3. Archives whose source files have not changed since they
+// have been uploaded by a previous run are skipped, unless forceRebuild is set.
+// The other existing archives are updated: their unchanged entries are copied over
+// and only new or updated files are downloaded. Zip archives which have been interrupted
+// are continued from their last checkpoint, if checkpoints are provided.
+// Every archive succeeds or fails on its own, a failed archive does not stop the others.
+// When the context is cancelled, the uploads which cannot be continued are aborted.
+// It returns the result of every archive.
+func zipAndUploadFiles(ctx context.Context, s3Config *s3Config, files []*fileInfo, zipConfigs []*zipConfig, forceRebuild bool, checkpoints *checkpointer, report *runReport) []archiveResult {
+	startTime := time.Now()
+	results := make([]archiveResult, len(zipConfigs))
+	for i, zipConfig := range zipConfigs {
+		results[i].name = zipConfig.zipName
 	}
-
-	if noOfZippedFiles == 0 {
-		log.Warnf("There is no content file on S3 to be added to archive with name %s. The s3 file prefix that has been used is %s", zipConfig.zipName, s3Config.archivesFolder)
-		return
+	//fail marks the archives from the provided one on as failed, unless they have already been skipped
+	fail := func(from int, err error) []archiveResult {
+		for i := from; i < len(results); i++ {
+			if results[i].status == "" {
+				results[i].status = archiveFailed
+				results[i].err = err
+				results[i].duration = time.Since(startTime)
+			}
+		}
+		return results
 	}
 
-	//upload zip file to s3
-	err = s3Config.uploadFile(tempZipFileName, zipConfig.zipName)
-	if err != nil {
-		errsCh <- fmt.Errorf("cannot upload zip with name %s to S3. Error was: %s", tempZipFileName, err)
+	if err := ctx.Err(); err != nil {
+		return fail(0, fmt.Errorf("zip creation has not been started: %w", err))
 	}
-}
-
-func createZipFiles(s3Config *s3Config, zipConfig *zipConfig) (string, int, error) {
-	log.Infof("Starting zip creation process for archive with name %s", zipConfig.zipName)
-	startTime := time.Now()
 
-	doneCh := make(chan struct{})
-	defer close(doneCh)
-
-	zipFile, err := ioutil.TempFile(os.TempDir(), zipConfig.zipName)
-	if err != nil {
-		return "", 0, fmt.Errorf("cannot create archive: %s", err)
+	//the files prefetched while the archives are selected are dropped once the archives are done, even if they have been skipped
+	defer s3Config.forgetPrefetchedFiles(files)
+	router := newArchiveRouter(s3Config)
+	router.report = report
+	router.checkpoints = checkpoints
+	for _, zipConfig := range zipConfigs {
+		router.addArchive(zipConfig, nil)
+	}
+	router.selectFiles(files)
+
+	//the zip files are streamed to the destination and to all the mirrors while they are being created,
+	//the uploads carry the source state of their archive as metadata, which is updated with the files written to it on Close
+	uploads := make([]*mirroredUpload, 0, len(zipConfigs))
+	for _, archive := range router.archives {
+		archive.destination = s3Config.withArchivesFolder(archive.zipConfig.archivesFolder)
+		upload := archive.destination.newMirroredUpload(ctx, archive.zipConfig.zipName, archive.sourceState.metadata())
+		uploads = append(uploads, upload)
+		archive.w = upload
 	}
-	defer zipFile.Close()
 
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
-	log.Infof("Starting to zip files into archive with name %s", zipConfig.zipName)
-	noOfZippedFiles := 0
+	for i, archive := range router.archives {
+		destination := archive.destination
+		if forceRebuild || archive.sourceState.count == 0 {
+			continue
+		}
 
-	for _, s3ObjectKey := range zipConfig.fileKeys {
-		if zipConfig.fileSelectorFn != nil {
-			isEligible, err := zipConfig.fileSelectorFn(zipConfig.year, s3ObjectKey)
-			if err != nil {
-				log.WithError(err).Errorf("cannot select S3 object with key %s.", s3ObjectKey)
-				continue
-			}
+		head, err := destination.headArchive(ctx, archive.zipConfig.zipName)
+		if err != nil {
+			log.WithError(err).Debugf("Cannot get metadata of existing archive with name %s, it will be rebuilt", archive.zipConfig.zipName)
+			continue
+		}
 
-			if !isEligible {
+		if archive.sourceState.matches(head.metadata) {
+			outdated := destination.outdatedSinks(ctx, archive.zipConfig.zipName, archive.sourceState)
+			if len(outdated) == 0 {
+				log.Infof("Source files of archive with name %s have not changed since it was uploaded, skipping it", archive.zipConfig.zipName)
+				archive.skipped = true
+				results[i].status = archiveSkipped
+				results[i].reason = "source files have not changed"
 				continue
 			}
+			log.Infof("Archive with name %s is outdated in sinks %s, it will be published again", archive.zipConfig.zipName, strings.Join(outdated, ", "))
 		}
 
-		noOfZippedFiles++
+		//start from the existing archive, so only new or updated files have to be downloaded
+		if archive.zipConfig.format.name != zipFormatName {
+			continue
+		}
+		previous, err := loadPreviousArchive(ctx, destination, archive.zipConfig.zipName, head)
+		if err != nil {
+			log.WithError(err).Warnf("Cannot reuse existing archive with name %s, it will be rebuilt from scratch", archive.zipConfig.zipName)
+			continue
+		}
+		archive.previous = previous
+	}
 
-		s3File, err := s3Config.downloadFile(s3ObjectKey, 3)
+	for i, archive := range router.archives {
+		if archive.zipConfig.format.name != zipFormatName {
+			continue
+		}
+		//the upload of a previous run is not continued by a skipped archive
+		if archive.skipped {
+			checkpoints.discardArchive(ctx, archive.destination, uploads[i].archiveKey())
+			continue
+		}
+
+		checkpoint := checkpoints.resumableCheckpoint(ctx, archive.destination, uploads[i].archiveKey(), archive.files)
+		if checkpoint == nil {
+			continue
+		}
+
+		err := uploads[i].resume(checkpoint.Upload)
 		if err != nil {
-			var aerr awserr.RequestFailure
-			ok := errors.As(err, &aerr)
-			if ok && aerr.StatusCode() == 404 {
-				log.Infof("File with name %s was deleted since the zip up process started for zip %s", s3ObjectKey, zipConfig.zipName)
-				continue
-			}
+			log.WithError(err).Warnf("Cannot resume archive with name %s, it will be built from scratch", archive.zipConfig.zipName)
+			checkpoints.discard(ctx, archive.destination, checkpoint)
+			continue
+		}
+		archive.resumeFrom(checkpoint)
+	}
 
-			return "", 0, fmt.Errorf("cannot download file with name %s from s3: %w", s3ObjectKey, err)
+	//discardUpload aborts the upload of the archive, so no incomplete multipart upload is left behind
+	discardUpload := func(i int) {
+		//uploads with a checkpoint are kept, so the next run can continue them
+		if router.archives[i].checkpointed {
+			log.Infof("Keeping upload of zip with name %s, it will be continued by the next run", router.archives[i].zipConfig.zipName)
+			return
 		}
+		abortUpload(uploads[i])
+	}
+	failArchive := func(i int, err error) {
+		results[i].status = archiveFailed
+		results[i].err = err
+		results[i].duration = time.Since(startTime)
+	}
 
-		//add file to zip
-		fileNameSplit := strings.Split(s3File.Key(), "/")
-		fileName := s3File.Key()
-		if len(fileNameSplit) > 0 {
-			fileName = fileNameSplit[len(fileNameSplit)-1]
+	//finish publishes the written archive with its sidecar files to all its sinks
+	finish := func(i int) {
+		archive, upload := router.archives[i], uploads[i]
+		results[i].noOfZippedFiles = archive.noOfZippedFiles
+		results[i].noOfReusedFiles = archive.noOfReusedFiles
+		results[i].noOfUnreadableFiles = archive.noOfUnreadableFiles
+		if archive.err != nil {
+			discardUpload(i)
+			failArchive(i, fmt.Errorf("zip creation failed: %w", archive.err))
+			return
 		}
 
-		h := &zip.FileHeader{
-			Name:   fileName,
-			Method: zip.Deflate,
-			Flags:  0x800,
+		if archive.noOfZippedFiles == 0 {
+			abortUpload(upload)
+			log.Warnf("There is no content file on S3 to be added to archive with name %s. The s3 file prefix that has been used is %s", archive.zipConfig.zipName, archive.zipConfig.sourceFolder)
+			results[i].status = archiveSkipped
+			results[i].reason = "there is no content file to be added"
+			return
 		}
-		f, err := zipWriter.CreateHeader(h)
+
+		//the checksum in the metadata tells the next run whether the sidecar files describe the archive
+		metadata := archive.sourceState.metadata()
+		metadata[archiveSHA256Metadata] = aws.String(upload.sha256())
+		upload.setMetadata(metadata)
+		err := upload.publish(archive.manifest)
 		if err != nil {
-			return "", 0, fmt.Errorf("cannot create zip header for file, error was: %s", err)
+			abortUpload(upload)
+			checkpoints.remove(ctx, upload.archiveKey())
+			results[i].sinks = upload.results()
+			failArchive(i, fmt.Errorf("cannot upload zip with name %s to S3: %w", archive.zipConfig.zipName, err))
+			return
+		}
+		checkpoints.remove(ctx, upload.archiveKey())
+
+		results[i].sinks = upload.results()
+		if err := failedSinksError(results[i].sinks); err != nil {
+			failArchive(i, fmt.Errorf("cannot publish zip with name %s to all its sinks: %w", archive.zipConfig.zipName, err))
+			return
 		}
 
-		_, err = io.Copy(f, s3File)
+		results[i].status = archiveSucceeded
+		results[i].duration = time.Since(startTime)
+	}
+
+	//every open archive holds a part in memory for each of its sinks, so at most maxOpenArchives of them are written at once.
+	//The batches are written one after the other, a file selected by archives of several batches is downloaded once for each of them.
+	pending := make([]int, 0, len(router.archives))
+	for i, archive := range router.archives {
+		if !archive.skipped {
+			pending = append(pending, i)
+		}
+	}
+	for len(pending) > 0 {
+		batch := pending
+		if s3Config.maxOpenArchives > 0 && len(batch) > s3Config.maxOpenArchives {
+			batch = batch[:s3Config.maxOpenArchives]
+		}
+
+		archives := make([]*routedArchive, 0, len(batch))
+		for _, i := range batch {
+			archives = append(archives, router.archives[i])
+		}
+		err := router.only(archives).write(ctx)
 		if err != nil {
-			return "", 0, fmt.Errorf("cannot add file to zip archive: %s", err)
+			for _, i := range pending {
+				discardUpload(i)
+			}
+			return fail(0, fmt.Errorf("zip creation failed: %w", err))
+		}
+
+		for _, i := range batch {
+			finish(i)
+		}
+		pending = pending[len(batch):]
+	}
+
+	return results
+}
+
+// zipAndUploadFolder lists the files of the source folder and builds all its archives from them.
+func zipAndUploadFolder(ctx context.Context, s3Config *s3Config, folder *sourceArchives, forceRebuild bool, checkpoints *checkpointer, report *runReport) []archiveResult {
+	log.Infof("Zipping up files from folder %s", folder.folder)
+	files, err := s3Config.listFiles(ctx, folder.folder)
+	if err != nil {
+		return failedResults(folder.archiveNames(), fmt.Errorf("cannot get file keys from s3: %w", err))
+	}
+
+	return zipAndUploadFiles(ctx, s3Config, files, folder.zipConfigs, forceRebuild, checkpoints, report)
+}
+
+// partBuffersSize is the most memory the parts of the archives which are being written take,
+// when maxNoOfFolders of the provided folders are zipped at the same time.
+func (s3Config *s3Config) partBuffersSize(folders []*sourceArchives, maxNoOfFolders int) int64 {
+	var partsSize int64
+	for _, sink := range s3Config.sinks() {
+		if s3Storage, ok := sink.config.storage.(*s3Storage); ok {
+			partsSize += int64(s3Storage.partSize)
+		}
+	}
+
+	openArchives := make([]int, 0, len(folders))
+	for _, folder := range folders {
+		noOfArchives := len(folder.zipConfigs)
+		if s3Config.maxOpenArchives > 0 && noOfArchives > s3Config.maxOpenArchives {
+			noOfArchives = s3Config.maxOpenArchives
 		}
+		openArchives = append(openArchives, noOfArchives)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(openArchives)))
+
+	var size int64
+	for i := 0; i < len(openArchives) && i < maxNoOfFolders; i++ {
+		size += int64(openArchives[i]) * partsSize
+	}
+	return size
+}
 
-		s3File.Close()
+// checkMemoryLimit rejects the runs whose part buffers can take more than half of the memory limit,
+// the other half is left for the downloaded files, the archive writers and the runtime.
+func (s3Config *s3Config) checkMemoryLimit(folders []*sourceArchives, maxNoOfFolders int, memoryLimit int64) error {
+	size := s3Config.partBuffersSize(folders, maxNoOfFolders)
+	if memoryLimit <= 0 || size <= memoryLimit/2 {
+		return nil
 	}
 
-	zippingUpDuration := time.Since(startTime)
-	log.Infof("Finished zip creation process for zip with name %s. Duration: %s. Number of zipped files is: %d", zipConfig.zipName, zippingUpDuration, noOfZippedFiles)
-	return zipFile.Name(), noOfZippedFiles, nil
+	return fmt.Errorf("the parts of the archives which are written at the same time can take %dMiB, more than half of the memory limit of %dMiB, lower the max number of open archives or goroutines", size>>20, memoryLimit>>20)
 }
 
-func isDateLessThanThirtyDaysBefore(date time.Time) bool {
-	thirtyDays := time.Duration(30 * 24 * time.Hour)
-	return time.Since(date) < thirtyDays
+func abortUpload(upload archiveUpload) {
+	if err := upload.Abort(); err != nil {
+		log.WithError(err).Errorf("Cannot abort upload of zip with key %s", upload.archiveKey())
+	}
 }
 
-func isContentFromProvidedYear(year int, s3ObjectKey string) (bool, error) {
-	s3ObjectDate, err := extractDateFromS3ObjectKey(s3ObjectKey)
+// zipAndUploadFileKeys builds a single archive from the files of the source folder
+// which the archive selects and uploads it to s3, with its sidecar files next to it.
+func zipAndUploadFileKeys(ctx context.Context, s3Config *s3Config, sourceFolder string, zipConfig *zipConfig) error {
+	files, err := s3Config.listFiles(ctx, sourceFolder)
 	if err != nil {
-		return false, fmt.Errorf("cannot extract date from file name %s, error was: %s", s3ObjectKey, err)
+		return fmt.Errorf("cannot get file keys from s3: %w", err)
 	}
 
-	if year == s3ObjectDate.Year() {
-		return true, nil
+	upload := s3Config.newMirroredUpload(ctx, zipConfig.zipName, nil)
+	archive, err := createZipFiles(ctx, s3Config, zipConfig, files, upload)
+	if err != nil {
+		abortUpload(upload)
+		return fmt.Errorf("zip creation failed: %w", err)
 	}
 
-	return false, nil
+	if archive.noOfZippedFiles == 0 {
+		abortUpload(upload)
+		return fmt.Errorf("there is no content file on S3 to be added to archive with name %s. The s3 file prefix that has been used is %s", zipConfig.zipName, sourceFolder)
+	}
+
+	//every sink gets its own sidecar files, which describe the archive it holds
+	err = upload.publish(archive.manifest)
+	if err != nil {
+		abortUpload(upload)
+		return fmt.Errorf("cannot upload zip with name %s to S3: %w", zipConfig.zipName, err)
+	}
+
+	err = failedSinksError(upload.results())
+	if err != nil {
+		return fmt.Errorf("cannot publish zip with name %s to all its sinks: %w", zipConfig.zipName, err)
+	}
+
+	return nil
 }
 
-func isContentLessThanThirtyDaysBefore(year int, s3ObjectKey string) (bool, error) {
-	s3ObjectDate, err := extractDateFromS3ObjectKey(s3ObjectKey)
+// createZipFiles writes a single archive with the selected files to w.
+func createZipFiles(ctx context.Context, s3Config *s3Config, zipConfig *zipConfig, files []*fileInfo, w io.Writer) (*routedArchive, error) {
+	log.Infof("Starting zip creation process for archive with name %s", zipConfig.zipName)
+
+	defer s3Config.forgetPrefetchedFiles(files)
+	router := newArchiveRouter(s3Config)
+	archive := router.addArchive(zipConfig, w)
+	err := router.route(ctx, files)
 	if err != nil {
-		return false, fmt.Errorf("cannot extract date from file name %s, error was: %s", s3ObjectKey, err)
+		return nil, err
+	}
+	if archive.err != nil {
+		return nil, archive.err
 	}
 
-	return isDateLessThanThirtyDaysBefore(s3ObjectDate), nil
+	return archive, nil
+}
+
+// yearSelector selects the files which have been published in the provided year.
+func yearSelector(extractDate dateExtractor, year int) fileSelector {
+	return dateSelector(extractDate, func(date time.Time) bool {
+		return date.Year() == year
+	})
+}
+
+// monthSelector selects the files which have been published in the provided month.
+func monthSelector(extractDate dateExtractor, year int, month time.Month) fileSelector {
+	return dateSelector(extractDate, func(date time.Time) bool {
+		return date.Year() == year && date.Month() == month
+	})
+}
+
+// quarterSelector selects the files which have been published in the provided quarter, numbered from 1 to 4.
+func quarterSelector(extractDate dateExtractor, year int, quarter int) fileSelector {
+	return dateSelector(extractDate, func(date time.Time) bool {
+		return date.Year() == year && quarterOf(date) == quarter
+	})
+}
+
+// rollingWindowSelector selects the files which have been published within the window before now.
+func rollingWindowSelector(extractDate dateExtractor, window time.Duration) fileSelector {
+	return dateSelector(extractDate, func(date time.Time) bool {
+		return isDateWithinWindow(date, window)
+	})
+}
+
+// dateRangeSelector selects the files which have been published between the provided days, both inclusive.
+func dateRangeSelector(extractDate dateExtractor, from, to time.Time) fileSelector {
+	return dateSelector(extractDate, func(date time.Time) bool {
+		day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+		return !day.Before(from) && !day.After(to)
+	})
+}
+
+// dateSelector selects the files whose publish date, extracted from their key, matches.
+func dateSelector(extractDate dateExtractor, matches func(date time.Time) bool) fileSelector {
+	return func(s3ObjectKey string) (bool, error) {
+		s3ObjectDate, err := extractDate(s3ObjectKey)
+		if err != nil {
+			return false, fmt.Errorf("cannot extract date from file name %s, error was: %s", s3ObjectKey, err)
+		}
+
+		return matches(s3ObjectDate), nil
+	}
+}
+
+// globSelector selects the files whose key matches the pattern, using the syntax of path.Match.
+func globSelector(pattern string) fileSelector {
+	return func(s3ObjectKey string) (bool, error) {
+		return path.Match(pattern, s3ObjectKey)
+	}
+}
+
+func quarterOf(date time.Time) int {
+	return (int(date.Month())-1)/3 + 1
+}
+
+func isDateWithinWindow(date time.Time, window time.Duration) bool {
+	return time.Since(date) < window
 }
 
 func extractDateFromS3ObjectKey(s3ObjectKey string) (time.Time, error) {
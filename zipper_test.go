@@ -1,87 +1,110 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"io"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
-const contentUUID = "00544bc0-679f-11e7-9d4e-ae21227e5abf"
+const (
+	contentUUID = "00544bc0-679f-11e7-9d4e-ae21227e5abf"
+	thirtyDays  = 30 * 24 * time.Hour
+)
 
 func init() {
 	log.SetLevel(log.ErrorLevel)
 }
 
-func TestIsDateLessThanThirtyDaysBeforeOneHourBefore(t *testing.T) {
+func TestIsDateWithinWindowOneHourBefore(t *testing.T) {
 	currentDate := time.Now()
 	previousDate := currentDate.Add(-1 * time.Hour)
 
-	dateLessThanThirtyDaysBefore := isDateLessThanThirtyDaysBefore(previousDate)
+	dateLessThanThirtyDaysBefore := isDateWithinWindow(previousDate, thirtyDays)
 
 	assert.True(t, dateLessThanThirtyDaysBefore)
 }
 
-func TestIsDateLessThanThirtyDaysBeforeFortyDaysBefore(t *testing.T) {
+func TestIsDateWithinWindowFortyDaysBefore(t *testing.T) {
 	currentDate := time.Now()
 	previousDate := currentDate.Add(-40 * 24 * time.Hour)
 
-	dateLessThanThirtyDaysBefore := isDateLessThanThirtyDaysBefore(previousDate)
+	dateLessThanThirtyDaysBefore := isDateWithinWindow(previousDate, thirtyDays)
 
 	assert.False(t, dateLessThanThirtyDaysBefore)
 }
 
-func TestIsContentLessThanThirtyDaysBefore(t *testing.T) {
+func TestRollingWindowSelectorLessThanThirtyDaysBefore(t *testing.T) {
 	currentDate := time.Now()
 	previousDay := currentDate.Add(-24 * time.Hour)
 	previousDayString := previousDay.Format(dateFormat)
 	fileNameLessThanThirtyDaysBefore := fmt.Sprintf("test/%s_%s.json", contentUUID, previousDayString)
 
-	contentLessThanThirtyDaysBefore, err := isContentLessThanThirtyDaysBefore(0, fileNameLessThanThirtyDaysBefore)
+	contentLessThanThirtyDaysBefore, err := rollingWindowSelector(extractDateFromS3ObjectKey, thirtyDays)(fileNameLessThanThirtyDaysBefore)
 
 	assert.Nil(t, err)
 	assert.True(t, contentLessThanThirtyDaysBefore)
 }
 
-func TestIsContentMoreThanThirtyDaysBefore(t *testing.T) {
+func TestRollingWindowSelectorMoreThanThirtyDaysBefore(t *testing.T) {
 	currentDate := time.Now()
 	previousDay := currentDate.Add(-24 * 40 * time.Hour)
 	previousDayString := previousDay.Format(dateFormat)
 	fileNameLessThanThirtyDaysBefore := fmt.Sprintf("test/%s_%s.json", contentUUID, previousDayString)
 
-	contentLessThanThirtyDaysBefore, err := isContentLessThanThirtyDaysBefore(0, fileNameLessThanThirtyDaysBefore)
+	contentLessThanThirtyDaysBefore, err := rollingWindowSelector(extractDateFromS3ObjectKey, thirtyDays)(fileNameLessThanThirtyDaysBefore)
 
 	assert.Nil(t, err)
 	assert.False(t, contentLessThanThirtyDaysBefore)
 }
 
-func TestIsContentLessThanThirtyDaysBeforeInvalidFileName(t *testing.T) {
-	_, err := isContentLessThanThirtyDaysBefore(0, contentUUID)
+func TestRollingWindowSelectorSevenDays(t *testing.T) {
+	tenDaysBefore := time.Now().Add(-10 * 24 * time.Hour).Format(dateFormat)
+	s3ObjectKey := fmt.Sprintf("test/%s_%s.json", contentUUID, tenDaysBefore)
+
+	lastSevenDays, err := rollingWindowSelector(extractDateFromS3ObjectKey, 7*24*time.Hour)(s3ObjectKey)
+	assert.Nil(t, err)
+	assert.False(t, lastSevenDays)
+
+	lastThirtyDays, err := rollingWindowSelector(extractDateFromS3ObjectKey, thirtyDays)(s3ObjectKey)
+	assert.Nil(t, err)
+	assert.True(t, lastThirtyDays)
+}
+
+func TestRollingWindowSelectorInvalidFileName(t *testing.T) {
+	_, err := rollingWindowSelector(extractDateFromS3ObjectKey, thirtyDays)(contentUUID)
 
 	assert.NotNil(t, err)
 }
 
-func TestIsContentMoreThanThirtyDaysBeforeInvalidDateFormat(t *testing.T) {
+func TestRollingWindowSelectorInvalidDateFormat(t *testing.T) {
 	currentDate := time.Now()
 	previousDay := currentDate.Add(-24 * 40 * time.Hour)
 	previousDayString := previousDay.Format(dateFormat)
 	fileNameLessThanThirtyDaysBefore := fmt.Sprintf("%s%s", previousDayString, contentUUID)
 
-	_, err := isContentLessThanThirtyDaysBefore(0, fileNameLessThanThirtyDaysBefore)
+	_, err := rollingWindowSelector(extractDateFromS3ObjectKey, thirtyDays)(fileNameLessThanThirtyDaysBefore)
 
 	assert.NotNil(t, err)
 }
 
 func TestZipFilesNoFiles(t *testing.T) {
 	s3Config := newS3Config(&mockS3Client{}, "test-bucket", "")
-	zipConfig := newZipConfig("", nil, 0, []string{})
+	zipConfig := newZipConfig("", zipFormat, allFilesSelectorName, nil, 0)
 
-	_, noOfZippedFiles, err := createZipFiles(s3Config, zipConfig)
+	archive, err := createZipFiles(context.Background(), s3Config, zipConfig, []*fileInfo{}, io.Discard)
 
 	assert.Nil(t, err)
-	assert.Zero(t, noOfZippedFiles)
+	assert.Zero(t, archive.noOfZippedFiles)
 }
 
 func TestExtractDateFromS3ObjectKeyValidObjectKey(t *testing.T) {
@@ -119,37 +142,456 @@ func TestExtractDateFromS3ObjectKeyInvalidDateFormat(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
-func TestIsContentFromProvidedYearProvidedYearIsTheSame(t *testing.T) {
+func TestYearSelectorProvidedYearIsTheSame(t *testing.T) {
 	s3ObjectKey := fmt.Sprintf("%s_2016-10-30.json", contentUUID)
 
-	isContentFromProvidedYearFlag, err := isContentFromProvidedYear(2016, s3ObjectKey)
+	isContentFromProvidedYearFlag, err := yearSelector(extractDateFromS3ObjectKey, 2016)(s3ObjectKey)
 
 	assert.Nil(t, err)
 	assert.True(t, isContentFromProvidedYearFlag)
 }
 
-func TestIsContentFromProvidedYearProvidedYearIsDifferent(t *testing.T) {
+func TestYearSelectorProvidedYearIsDifferent(t *testing.T) {
 	s3ObjectKey := fmt.Sprintf("%s_2016-10-30.json", contentUUID)
 
-	isContentFromProvidedYearFlag, err := isContentFromProvidedYear(2017, s3ObjectKey)
+	isContentFromProvidedYearFlag, err := yearSelector(extractDateFromS3ObjectKey, 2017)(s3ObjectKey)
 
 	assert.Nil(t, err)
 	assert.False(t, isContentFromProvidedYearFlag)
 }
 
-func TestIsContentFromProvidedYearProvidedKeyIsInvalid(t *testing.T) {
+func TestYearSelectorProvidedKeyIsInvalid(t *testing.T) {
 	s3ObjectKey := fmt.Sprintf("%s.json", contentUUID)
 
-	_, err := isContentFromProvidedYear(2017, s3ObjectKey)
+	_, err := yearSelector(extractDateFromS3ObjectKey, 2017)(s3ObjectKey)
 
 	assert.NotNil(t, err)
 }
 
 func TestZipFilesInvalidFileName(t *testing.T) {
 	s3Config := newS3Config(&mockS3Client{}, "test-bucket", "")
-	zipConfig := newZipConfig("yearly-archive-2017.zip", nil, 2017, []string{"invalid-file"})
+	zipConfig := newZipConfig("yearly-archive-2017", zipFormat, allFilesSelectorName, nil, 2017)
 
-	_, _, err := createZipFiles(s3Config, zipConfig)
+	_, err := createZipFiles(context.Background(), s3Config, zipConfig, []*fileInfo{{key: "invalid-file"}}, io.Discard)
 
 	assert.NotNil(t, err)
 }
+
+// storeTestSidecars stores the sidecar files of an archive with the provided checksum and source fingerprint.
+func storeTestSidecars(t *testing.T, s3Config *s3Config, zipName, checksum, fingerprint string) {
+	ctx := context.Background()
+	manifest, err := json.Marshal(&archiveManifest{ArchiveName: zipName, SourceFingerprint: fingerprint})
+	assert.Nil(t, err)
+	metadata, err := json.Marshal(&archiveMetadata{ArchiveName: zipName, SHA256: checksum})
+	assert.Nil(t, err)
+
+	assert.Nil(t, s3Config.uploadSidecarFile(ctx, manifestFileName(zipName), manifest, "application/json"))
+	assert.Nil(t, s3Config.uploadSidecarFile(ctx, checksumFileName(zipName), checksumFileContent(checksum, zipName), "text/plain"))
+	assert.Nil(t, s3Config.uploadSidecarFile(ctx, metadataFileName(zipName), metadata, "application/json"))
+}
+
+func TestZipAndUploadFilesSkipsUnchangedArchive(t *testing.T) {
+	files := []*fileInfo{
+		{key: fmt.Sprintf("test-folder/%s_2016-10-30.json", contentUUID), eTag: "etag"},
+	}
+	zipConfigs := []*zipConfig{newZipConfig("FT-archive-2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016)}
+	const checksum = "0123abcd"
+	unchanged := newSourceState(files).metadata()
+	unchanged[archiveSHA256Metadata] = aws.String(checksum)
+
+	tests := map[string]struct {
+		headMetadata map[string]*string
+		sidecars     bool
+		forceRebuild bool
+		wantRebuild  bool
+	}{
+		"Unchanged": {
+			headMetadata: unchanged,
+			sidecars:     true,
+		},
+		"UnchangedWithForceRebuild": {
+			headMetadata: unchanged,
+			sidecars:     true,
+			forceRebuild: true,
+			wantRebuild:  true,
+		},
+		"UnchangedWithoutSidecars": {
+			headMetadata: unchanged,
+			wantRebuild:  true,
+		},
+		"Changed": {
+			headMetadata: newSourceState([]*fileInfo{{key: files[0].key, eTag: "old-etag"}}).metadata(),
+			sidecars:     true,
+			wantRebuild:  true,
+		},
+		"NoExistingArchive": {
+			wantRebuild: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			mockClient := &mockS3Client{headMetadata: test.headMetadata}
+			s3Config := newS3Config(mockClient, "test-bucket", "archives")
+			if test.sidecars {
+				storeTestSidecars(t, s3Config, "FT-archive-2016.zip", checksum, newSourceState(files).fingerprint)
+			}
+
+			results := zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, test.forceRebuild, nil, nil)
+
+			assert.False(t, hasFailures(results))
+			_, _, uploaded := mockClient.storedObject("archives/FT-archive-2016.zip")
+			assert.Equal(t, test.wantRebuild, uploaded)
+			assert.Equal(t, test.wantRebuild, mockClient.getObjectCalls == 1)
+		})
+	}
+}
+
+func TestZipAndUploadFilesPublishesArchiveWithItsSidecars(t *testing.T) {
+	files := []*fileInfo{
+		{key: fmt.Sprintf("test-folder/%s_2016-10-30.json", contentUUID), eTag: "etag"},
+	}
+	zipConfigs := []*zipConfig{newZipConfig("FT-archive-2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016)}
+	mockClient := &mockS3Client{failingKeys: map[string]bool{"archives/FT-archive-2016.zip.sha256": true}}
+	bucket := newS3Storage(mockClient, "test-bucket")
+	bucket.retry = newTestRetryPolicy()
+	s3Config := newStorageConfig(bucket, "archives")
+
+	results := zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, nil, nil)
+	assert.Equal(t, archiveFailed, results[0].status)
+	_, _, ok := mockClient.storedObject("archives/FT-archive-2016.zip")
+	assert.False(t, ok, "an archive is not published without its sidecar files")
+
+	//the archive is published once its sidecar files can be uploaded
+	mockClient.failingKeys = nil
+	results = zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, nil, nil)
+	assert.Equal(t, archiveSucceeded, results[0].status)
+	for _, name := range []string{"FT-archive-2016.zip.sha256", "FT-archive-2016.zip.meta.json", "FT-archive-2016.zip.manifest.json"} {
+		_, _, ok := mockClient.storedObject("archives/" + name)
+		assert.True(t, ok, name)
+	}
+
+	results = zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, nil, nil)
+	assert.Equal(t, archiveSkipped, results[0].status)
+}
+
+func TestZipAndUploadFilesReusesExistingArchive(t *testing.T) {
+	keys := []string{
+		fmt.Sprintf("test-folder/%s_2016-01-01.json", "0b2d3f6a-5b4e-11e7-9bc8-8055f264aa8b"),
+		fmt.Sprintf("test-folder/%s_2016-02-01.json", "1f0a0b6e-5b4e-11e7-9bc8-8055f264aa8b"),
+		fmt.Sprintf("test-folder/%s_2016-03-01.json", "2a1c5d0e-5b4e-11e7-9bc8-8055f264aa8b"),
+		fmt.Sprintf("test-folder/%s_2016-04-01.json", "3b4e6f1a-5b4e-11e7-9bc8-8055f264aa8b"),
+	}
+	zipConfigs := []*zipConfig{newZipConfig("FT-archive-2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016)}
+	mockClient := &mockS3Client{}
+	bucket := newS3Storage(mockClient, "test-bucket")
+	bucket.partSize = 64
+	s3Config := newStorageConfig(bucket, "archives")
+
+	run := func(files []*fileInfo) {
+		results := zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, nil, nil)
+		assert.False(t, hasFailures(results))
+	}
+
+	run([]*fileInfo{
+		{key: keys[0], eTag: "etag-0"},
+		{key: keys[1], eTag: "etag-1"},
+		{key: keys[2], eTag: "etag-2"},
+	})
+	assert.Equal(t, int64(3), mockClient.getObjectCalls)
+
+	//second file is updated, third is deleted and fourth is new
+	mockClient.getObjectCalls = 0
+	run([]*fileInfo{
+		{key: keys[0], eTag: "etag-0"},
+		{key: keys[1], eTag: "etag-1-updated"},
+		{key: keys[3], eTag: "etag-3"},
+	})
+	assert.Equal(t, int64(2), mockClient.getObjectCalls)
+
+	data, _, ok := mockClient.storedObject("archives/FT-archive-2016.zip")
+	assert.True(t, ok)
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.Nil(t, err)
+	assert.Len(t, zipReader.File, 4)
+	assert.Equal(t, manifestEntryName, zipReader.File[3].Name)
+	for i, key := range []string{keys[0], keys[1], keys[3]} {
+		f, err := zipReader.File[i].Open()
+		assert.Nil(t, err)
+		content, err := io.ReadAll(f)
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(content))
+	}
+
+	manifest, err := s3Config.getManifest(context.Background(), "FT-archive-2016.zip")
+	assert.Nil(t, err)
+	assert.Equal(t, "etag-1-updated", manifest.Entries[1].ETag)
+	assert.Equal(t, keys[3], manifest.Entries[2].Key)
+
+	checksum, _, ok := mockClient.storedObject("archives/FT-archive-2016.zip.sha256")
+	assert.True(t, ok)
+	assert.Equal(t, fmt.Sprintf("%x  FT-archive-2016.zip\n", sha256.Sum256(data)), string(checksum))
+
+	_, _, ok = mockClient.storedObject("archives/FT-archive-2016.zip.meta.json")
+	assert.True(t, ok)
+}
+
+func TestZipAndUploadFilesCancelled(t *testing.T) {
+	files := []*fileInfo{
+		{key: fmt.Sprintf("test-folder/%s_2016-10-30.json", contentUUID), eTag: "etag"},
+	}
+	zipConfigs := []*zipConfig{newZipConfig("FT-archive-2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016)}
+	mockClient := &mockS3Client{}
+	s3Config := newS3Config(mockClient, "test-bucket", "archives")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results := zipAndUploadFiles(ctx, s3Config, files, zipConfigs, false, nil, nil)
+
+	assert.True(t, hasFailures(results))
+	assert.Equal(t, int64(0), mockClient.getObjectCalls)
+	_, _, uploaded := mockClient.storedObject("archives/FT-archive-2016.zip")
+	assert.False(t, uploaded)
+}
+
+func TestZipAndUploadFilesFailsArchivesOnTheirOwn(t *testing.T) {
+	files := []*fileInfo{
+		{key: fmt.Sprintf("test-folder/%s_2016-10-30.json", contentUUID), eTag: "etag-2016"},
+		{key: fmt.Sprintf("test-folder/%s_2017-10-30.json", contentUUID), eTag: "etag-2017"},
+	}
+	zipConfigs := []*zipConfig{
+		newZipConfig("FT-archive-2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016),
+		newZipConfig("FT-archive-2017", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2017), 2017),
+	}
+	mockClient := &mockS3Client{failingKeys: map[string]bool{"archives/FT-archive-2016.zip": true}}
+	bucket := newS3Storage(mockClient, "test-bucket")
+	bucket.retry = newTestRetryPolicy()
+	s3Config := newStorageConfig(bucket, "archives")
+
+	results := zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, nil, nil)
+
+	assert.Equal(t, archiveFailed, results[0].status)
+	assert.Error(t, results[0].err)
+	assert.Equal(t, archiveSucceeded, results[1].status)
+	_, _, uploaded := mockClient.storedObject("archives/FT-archive-2016.zip")
+	assert.False(t, uploaded)
+	_, _, uploaded = mockClient.storedObject("archives/FT-archive-2017.zip")
+	assert.True(t, uploaded)
+}
+
+func TestZipAndUploadFilesUnreadableFiles(t *testing.T) {
+	files := []*fileInfo{
+		{key: fmt.Sprintf("test-folder/%s_2016-10-30.json", contentUUID), eTag: "etag-2016"},
+		{key: fmt.Sprintf("test-folder/unreadable-%s_2016-11-30.json", contentUUID), eTag: "etag-unreadable"},
+		{key: fmt.Sprintf("test-folder/%s_2017-10-30.json", contentUUID), eTag: "etag-2017"},
+	}
+
+	tests := map[string]struct {
+		maxUnreadableFiles int
+		wantStatus         string
+		wantSkippedKeys    int
+	}{
+		"WithinErrorBudget": {
+			maxUnreadableFiles: 1,
+			wantStatus:         archiveSucceeded,
+			wantSkippedKeys:    1,
+		},
+		"ErrorBudgetExceeded": {
+			maxUnreadableFiles: 0,
+			wantStatus:         archiveFailed,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			zipConfigs := []*zipConfig{
+				newZipConfig("FT-archive-2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016),
+				newZipConfig("FT-archive-2017", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2017), 2017),
+			}
+			zipConfigs[0].maxUnreadableFiles = test.maxUnreadableFiles
+			mockClient := &mockS3Client{}
+			bucket := newS3Storage(mockClient, "test-bucket")
+			bucket.retry = newTestRetryPolicy()
+			s3Config := newStorageConfig(bucket, "archives")
+			report := newRunReport(time.Now())
+
+			results := zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, nil, report)
+
+			assert.Equal(t, test.wantStatus, results[0].status)
+			assert.Equal(t, 1, results[0].noOfUnreadableFiles)
+			assert.Equal(t, 1, results[0].noOfZippedFiles, "the unreadable file is not counted as zipped")
+			assert.Equal(t, archiveSucceeded, results[1].status)
+			assert.Len(t, report.SkippedKeys, test.wantSkippedKeys)
+
+			data, metadata, uploaded := mockClient.storedObject("archives/FT-archive-2016.zip")
+			assert.Equal(t, test.wantStatus == archiveSucceeded, uploaded)
+			if uploaded {
+				zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+				assert.Nil(t, err)
+				assert.Len(t, zipReader.File, 2, "the unreadable file is left out next to the manifest")
+				assert.False(t, newSourceState(files[:2]).matches(metadata), "the next run has to add the unreadable file")
+				assert.True(t, newSourceState(files[:1]).matches(metadata))
+			}
+		})
+	}
+}
+
+func TestZipAndUploadFilesInBatches(t *testing.T) {
+	files := []*fileInfo{
+		{key: fmt.Sprintf("test-folder/%s_2016-10-30.json", contentUUID), eTag: "etag-2016"},
+		{key: fmt.Sprintf("test-folder/%s_2017-10-30.json", contentUUID), eTag: "etag-2017"},
+		{key: "test-folder/undated.json", eTag: "etag-undated"},
+	}
+	zipConfigs := []*zipConfig{
+		newZipConfig("FT-archive-2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016),
+		newZipConfig("FT-archive-2017", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2017), 2017),
+		newZipConfig(undatedArchiveName, zipFormat, undatedSelectorName, nil, 0),
+	}
+	mockClient := &mockS3Client{}
+	s3Config := newS3Config(mockClient, "test-bucket", "archives")
+	s3Config.maxOpenArchives = 2
+	report := newRunReport(time.Now())
+
+	results := zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, nil, report)
+
+	for _, result := range results {
+		assert.Equal(t, archiveSucceeded, result.status)
+		assert.Equal(t, 1, result.noOfZippedFiles)
+	}
+	assert.Len(t, report.SkippedKeys, 1, "the files are selected once for all the batches")
+	data, _, uploaded := mockClient.storedObject("archives/FT-archive-undated.zip")
+	assert.True(t, uploaded)
+	assert.Equal(t, []string{"undated.json", manifestEntryName}, zipEntryNames(t, data))
+}
+
+func TestCheckMemoryLimit(t *testing.T) {
+	folders := []*sourceArchives{
+		{folder: "content", zipConfigs: make([]*zipConfig, 40)},
+		{folder: "concepts", zipConfigs: make([]*zipConfig, 1)},
+	}
+
+	tests := map[string]struct {
+		maxOpenArchives int
+		maxNoOfFolders  int
+		memoryLimit     int64
+		wantErr         bool
+	}{
+		"OpenArchivesFit": {
+			maxOpenArchives: 24,
+			maxNoOfFolders:  3,
+			memoryLimit:     1 << 30,
+		},
+		"AllArchivesOpen": {
+			maxOpenArchives: 0,
+			maxNoOfFolders:  3,
+			memoryLimit:     512 << 20,
+			wantErr:         true,
+		},
+		"NoLimit": {
+			maxOpenArchives: 0,
+			maxNoOfFolders:  3,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s3Config := newS3Config(&mockS3Client{}, "test-bucket", "archives")
+			s3Config.maxOpenArchives = test.maxOpenArchives
+
+			err := s3Config.checkMemoryLimit(folders, test.maxNoOfFolders, test.memoryLimit)
+			assert.Equal(t, test.wantErr, err != nil)
+		})
+	}
+}
+
+func TestPartBuffersSize(t *testing.T) {
+	folders := []*sourceArchives{
+		{folder: "content", zipConfigs: make([]*zipConfig, 40)},
+		{folder: "concepts", zipConfigs: make([]*zipConfig, 1)},
+	}
+	s3Config := newS3Config(&mockS3Client{}, "test-bucket", "archives")
+	s3Config.maxOpenArchives = 24
+	s3Config.mirrors = []mirror{
+		{name: "s3://dr-bucket", storage: newS3Storage(&mockS3Client{}, "dr-bucket")},
+		{name: "file:///mnt/archives", storage: newDirStorage(t.TempDir())},
+	}
+
+	assert.Equal(t, int64(25*2*defaultUploadPartSize), s3Config.partBuffersSize(folders, 3))
+	assert.Equal(t, int64(24*2*defaultUploadPartSize), s3Config.partBuffersSize(folders, 1))
+}
+
+func TestZipAndUploadFilesAllFilesUnreadable(t *testing.T) {
+	files := []*fileInfo{
+		{key: fmt.Sprintf("test-folder/unreadable-%s_2016-11-30.json", contentUUID), eTag: "etag-unreadable"},
+	}
+	zipConfigs := []*zipConfig{newZipConfig("FT-archive-2016", zipFormat, yearSelectorName, yearSelector(extractDateFromS3ObjectKey, 2016), 2016)}
+	zipConfigs[0].maxUnreadableFiles = 1
+	mockClient := &mockS3Client{}
+	bucket := newS3Storage(mockClient, "test-bucket")
+	bucket.retry = newTestRetryPolicy()
+	s3Config := newStorageConfig(bucket, "archives")
+
+	results := zipAndUploadFiles(context.Background(), s3Config, files, zipConfigs, false, nil, nil)
+
+	assert.Equal(t, archiveSkipped, results[0].status)
+	assert.Equal(t, 0, results[0].noOfZippedFiles)
+	_, _, uploaded := mockClient.storedObject("archives/FT-archive-2016.zip")
+	assert.False(t, uploaded, "an archive without any readable file is not uploaded")
+}
+
+func TestZipAndUploadFileKeys(t *testing.T) {
+	mockClient := &mockS3Client{}
+	s3Config := newS3Config(mockClient, "test-bucket", "archives")
+	zipConfig := newZipConfig("FT-archive-files", zipFormat, globSelectorName, globSelector("test-folder/file[12].txt"), 0)
+
+	err := zipAndUploadFileKeys(context.Background(), s3Config, "test-folder", zipConfig)
+	assert.NoError(t, err)
+
+	data, _, uploaded := mockClient.storedObject("archives/FT-archive-files.zip")
+	assert.True(t, uploaded)
+	assert.Equal(t, []string{"file1.txt", "file2.txt", manifestEntryName}, zipEntryNames(t, data))
+
+	checksum, _, ok := mockClient.storedObject("archives/FT-archive-files.zip.sha256")
+	assert.True(t, ok)
+	assert.Equal(t, fmt.Sprintf("%x  FT-archive-files.zip\n", sha256.Sum256(data)), string(checksum))
+	_, _, ok = mockClient.storedObject("archives/FT-archive-files.zip.meta.json")
+	assert.True(t, ok)
+	manifest, err := s3Config.getManifest(context.Background(), "FT-archive-files.zip")
+	assert.Nil(t, err)
+	assert.Len(t, manifest.Entries, 2)
+	for _, entry := range manifest.Entries {
+		assert.NotEmpty(t, entry.ETag)
+	}
+}
+
+func TestZipAndUploadFileKeysToDestinationBucket(t *testing.T) {
+	sourceClient := &mockS3Client{}
+	destinationClient := &mockS3Client{}
+	s3Config := newS3Config(destinationClient, "archives-bucket", "archives")
+	s3Config.source = newS3Storage(sourceClient, "test-bucket")
+	zipConfig := newZipConfig("FT-archive-files", zipFormat, globSelectorName, globSelector("test-folder/file[12].txt"), 0)
+
+	err := zipAndUploadFileKeys(context.Background(), s3Config, "test-folder", zipConfig)
+	assert.NoError(t, err)
+
+	data, _, uploaded := destinationClient.storedObject("archives/FT-archive-files.zip")
+	assert.True(t, uploaded)
+	assert.Equal(t, []string{"file1.txt", "file2.txt", manifestEntryName}, zipEntryNames(t, data))
+	assert.Equal(t, int64(2), sourceClient.getObjectCalls)
+	assert.Equal(t, int64(0), destinationClient.getObjectCalls)
+	assert.Empty(t, sourceClient.objects, "nothing should be written to the source bucket")
+}
+
+func TestZipAndUploadFileKeysNoSelectedFiles(t *testing.T) {
+	mockClient := &mockS3Client{}
+	s3Config := newS3Config(mockClient, "test-bucket", "archives")
+	from := time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2021, time.June, 30, 0, 0, 0, 0, time.UTC)
+	zipConfig := newZipConfig("FT-archive-2021-03-01-to-2021-06-30", zipFormat, dateRangeSelectorName, dateRangeSelector(extractDateFromS3ObjectKey, from, to), 0)
+
+	err := zipAndUploadFileKeys(context.Background(), s3Config, "test-folder", zipConfig)
+	assert.Error(t, err)
+
+	_, _, uploaded := mockClient.storedObject("archives/FT-archive-2021-03-01-to-2021-06-30.zip")
+	assert.False(t, uploaded)
+}